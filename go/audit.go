@@ -0,0 +1,56 @@
+package main
+
+//
+// audit - a record of each export in the local syslog, for visibility of
+// when and where exports happen across a fleet
+//
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// auditLog receives the outcome of a run. The platform's syslog writer
+// provides it, where there is one
+type auditLog interface {
+	Info(message string) error
+	Err(message string) error
+}
+
+// the names of the fields an export holds, after any exclusions
+func exportedFields(content *cephMetaData, settings *runtimeSettings) []string {
+	var fields map[string]interface{}
+	json.Unmarshal(toJSON(fieldView(content, settings), ""), &fields)
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// record a successful export
+func auditExport(audit auditLog, content *cephMetaData, settings *runtimeSettings) {
+	var destinations []string
+	if settings.outFile != "" {
+		destinations = append(destinations, settings.outFile)
+	}
+	if settings.s3Bucket != "" {
+		destinations = append(destinations, "s3://"+settings.s3Bucket+"/"+settings.s3Key)
+	}
+	if settings.k8sApply {
+		// without a namespace, kubectl applies to its current one
+		name := settings.k8sName
+		if settings.k8sNamespace != "" {
+			name = settings.k8sNamespace + "/" + name
+		}
+		destinations = append(destinations, "k8s configmap and secret "+name)
+	}
+	if settings.socket != "" {
+		destinations = append(destinations, "socket "+settings.socket)
+	}
+	audit.Info("exported cluster " + content.Fingerprint + " to " + strings.Join(destinations, " and ") +
+		" (fields " + strings.Join(exportedFields(content, settings), ",") + ")")
+}
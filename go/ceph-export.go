@@ -8,289 +8,2677 @@ package main
 //
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/ini.v1"
 	"gopkg.in/yaml.v2"
 )
 
-// keyringFile is the filename pattern for a keyring
+// keyringFile is the default filename pattern for a keyring
 const keyringFile = "ceph.client.%s.keyring"
 
+// redacted replaces values masked in the export
+const redacted = "REDACTED"
+
+// defaultMaxOutputSize caps the size of an export, in bytes
+const defaultMaxOutputSize = 16 * 1024 * 1024
+
 var defaults = map[string]string{
-	"outFile":    "~/rhcs-export",
-	"confDir":    "/etc/ceph",
-	"fileFormat": "json",
-	"userName":   "admin",
+	"outFile":         "~/rhcs-export",
+	"confDir":         "/etc/ceph",
+	"fileFormat":      "json",
+	"userName":        "admin",
+	"keyringPattern":  keyringFile,
+	"cluster":         "ceph",
+	"onUnhealthy":     "warn",
+	"jsonIndent":      "4",
+	"k8sName":         "rhcs-export",
+	"addressFamily":   "ipv4",
+	"syslogFacility":  "user",
+	"syslogTag":       "ceph-export",
+	"errorFormat":     "text",
+	"secretFormat":    "raw",
+	"clusterLabelKey": "cluster_label",
+}
+
+// Runtime settings
+type runtimeSettings struct {
+	outFile         string
+	confDir         string
+	fileFormat      string
+	userName        string
+	cephID          string
+	keyringPattern  string
+	cluster         string
+	cephArgs        []string
+	strict          bool
+	includeOps      bool
+	includePools    bool
+	includeVersions bool
+	force           bool
+	assumeYes       bool
+	onUnhealthy     string
+	configFd        int
+	keyringFd       int
+	trimDomain      string
+	noSecret        bool
+	maxOutputSize   int64
+	jsonIndent      string
+	compactSlices   bool
+	redactURLs      bool
+	profile         string
+	exclude         []string
+	wrap            string
+	timeout         time.Duration
+	collectTimeout  time.Duration
+	s3Bucket        string
+	s3Key           string
+	includeAll      bool
+	noOps           bool
+	noPools         bool
+	noVersions      bool
+	includeReleases bool
+	noReleases      bool
+	captureDir      string
+	outputOwner     string
+	outputGroup     string
+	parallel        int
+	gpgRecipients   []string
+	withProvenance  bool
+	secretFormat    string
+	clusterLabel    string
+	clusterLabelKey string
+	verifyEndpoints bool
+	umask           string
+	socket          string
+	k8sApply        bool
+	requireFields   []string
+	requireDash     bool
+
+	// includeDashboardUser is opt in, and left out of --include-all, as it
+	// names an account on the cluster
+	includeDashboardUser bool
+
+	// clusters and confDirs hold every use of --cluster and --confdir,
+	// which select several clusters when repeated
+	clusters []string
+	confDirs []string
+
+	// ownerID and groupID are the numeric --output-owner and --output-group,
+	// or -1 to leave them unchanged
+	ownerID           int
+	groupID           int
+	ext               string
+	confPath          string
+	keyringPath       string
+	k8sName           string
+	k8sNamespace      string
+	noHostname        bool
+	templateFile      string
+	templateName      string
+	failOnWarn        bool
+	omitemptyOff      bool
+	addressFamily     string
+	onlyIfChanged     bool
+	cephadm           bool
+	cephadmFsid       string
+	cephadmImage      string
+	healthMinSeverity string
+	redactNetworks    bool
+	syslog            bool
+	syslogFacility    string
+	syslogTag         string
+
+	// indent is the json indentation derived from --json-indent
+	indent string
+
+	// content read from --config-fd and --keyring-fd
+	configData  []byte
+	keyringData []byte
+
+	// progress receives the step by step status of an export
+	progress io.Writer
+
+	// clock stamps the export, and is fixed by the self test
+	clock Clock
+}
+
+// Clock tells the time an export is collected at
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// exported ceph configuration metadata
+type cephMetaData struct {
+	DashboardURL string `json:"dashboard_url" yaml:"dashboard_url"`
+	DashboardTLS bool   `json:"dashboard_tls" yaml:"dashboard_tls"`
+
+	DashboardOnActiveMgr  *bool `json:"dashboard_on_active_mgr,omitempty" yaml:"dashboard_on_active_mgr,omitempty"`
+	PrometheusOnActiveMgr *bool `json:"prometheus_on_active_mgr,omitempty" yaml:"prometheus_on_active_mgr,omitempty"`
+
+	DashboardReachable  *bool `json:"dashboard_reachable,omitempty" yaml:"dashboard_reachable,omitempty"`
+	PrometheusReachable *bool `json:"prometheus_reachable,omitempty" yaml:"prometheus_reachable,omitempty"`
+
+	Fsid        string `json:"fsid" yaml:"fsid"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+	ClusterName string `json:"cluster_name" yaml:"cluster_name"`
+
+	PublicNetwork  string `json:"public_network,omitempty" yaml:"public_network,omitempty"`
+	ClusterNetwork string `json:"cluster_network,omitempty" yaml:"cluster_network,omitempty"`
+
+	Secret     string   `json:"secret" yaml:"secret"`
+	Mgr        string   `json:"mgr" yaml:"mgr"`
+	MgrAddr    string   `json:"mgr_addr" yaml:"mgr_addr"`
+	MgrPort    int      `json:"mgr_port" yaml:"mgr_port"`
+	Mgrstandby []string `json:"mgr_standby" yaml:"mgr_standby"`
+	Mons       []string `json:"mons" yaml:"mons"`
+	MonV2      []string `json:"mon_v2" yaml:"mon_v2"`
+
+	MonPublicAddrs []MonPublicAddrs `json:"mon_public_addrs" yaml:"mon_public_addrs"`
+
+	PrometheusURL string   `json:"prometheus_url" yaml:"prometheus_url"`
+	Rgws          []string `json:"rgws" yaml:"rgws"`
+	RgwEndpoints  []string `json:"rgw_endpoints" yaml:"rgw_endpoints"`
+	RgwDaemons    []string `json:"rgw_daemons" yaml:"rgw_daemons"`
+	Version       string   `json:"version" yaml:"version"`
+	ReleaseName   string   `json:"release_name" yaml:"release_name"`
+	MonmapEpoch   int      `json:"monmap_epoch" yaml:"monmap_epoch"`
+	ElectionEpoch int      `json:"election_epoch" yaml:"election_epoch"`
+
+	MonmapCreated  string `json:"monmap_created,omitempty" yaml:"monmap_created,omitempty"`
+	MonmapModified string `json:"monmap_modified,omitempty" yaml:"monmap_modified,omitempty"`
+
+	EnabledModules []string      `json:"enabled_modules" yaml:"enabled_modules"`
+	HealthChecks   []HealthCheck `json:"health_checks" yaml:"health_checks"`
+
+	PGCount  int            `json:"pg_count" yaml:"pg_count"`
+	PGStates map[string]int `json:"pg_states" yaml:"pg_states"`
+
+	TelemetryEnabled *bool  `json:"telemetry_enabled,omitempty" yaml:"telemetry_enabled,omitempty"`
+	BalancerMode     string `json:"balancer_mode,omitempty" yaml:"balancer_mode,omitempty"`
+
+	Balancer *Balancer `json:"balancer,omitempty" yaml:"balancer,omitempty"`
+
+	DashboardCustomCert *bool `json:"dashboard_custom_cert,omitempty" yaml:"dashboard_custom_cert,omitempty"`
+
+	// only ever the user name, the password is never collected
+	DashboardUser string `json:"dashboard_user,omitempty" yaml:"dashboard_user,omitempty"`
+
+	Autoscale []AutoscalePool `json:"autoscale,omitempty" yaml:"autoscale,omitempty"`
+
+	Ratios *Ratios `json:"ratios,omitempty" yaml:"ratios,omitempty"`
+
+	DaemonVersions map[string]map[string]int `json:"daemon_versions,omitempty" yaml:"daemon_versions,omitempty"`
+
+	RequireOSDRelease string `json:"require_osd_release,omitempty" yaml:"require_osd_release,omitempty"`
+	MinMonRelease     string `json:"min_mon_release,omitempty" yaml:"min_mon_release,omitempty"`
+
+	ExportedFrom string `json:"exported_from,omitempty" yaml:"exported_from,omitempty"`
+	ExportedAt   string `json:"exported_at" yaml:"exported_at"`
+
+	Custom map[string]interface{} `json:"custom,omitempty" yaml:"custom,omitempty"`
+
+	Provenance map[string]string `json:"_provenance,omitempty" yaml:"_provenance,omitempty"`
+}
+
+// Ratios are the osd fullness thresholds, as fractions of capacity
+type Ratios struct {
+	Full         float64 `json:"full" yaml:"full"`
+	Nearfull     float64 `json:"nearfull" yaml:"nearfull"`
+	Backfillfull float64 `json:"backfillfull" yaml:"backfillfull"`
+}
+
+// AutoscalePool is the pg autoscaler state of a pool
+type AutoscalePool struct {
+	Pool     string `json:"pool" yaml:"pool"`
+	PgNum    int    `json:"pg_num" yaml:"pg_num"`
+	PgTarget int    `json:"pg_target" yaml:"pg_target"`
+	Mode     string `json:"mode" yaml:"mode"`
+}
+
+// MonAddress is one of the addresses a mon listens on, with its msgr
+// protocol (v1 or v2)
+type MonAddress struct {
+	Type string `json:"type" yaml:"type"`
+	Addr string `json:"addr" yaml:"addr"`
+}
+
+// MonPublicAddrs holds every public address of a mon
+type MonPublicAddrs struct {
+	Name  string       `json:"name" yaml:"name"`
+	Addrs []MonAddress `json:"addrs" yaml:"addrs"`
+}
+
+// Balancer is the state of the balancer module, and whether any pgs are
+// placed by upmap entries
+type Balancer struct {
+	Mode                 string `json:"mode" yaml:"mode"`
+	Active               bool   `json:"active" yaml:"active"`
+	LastOptimizeStarted  string `json:"last_optimize_started,omitempty" yaml:"last_optimize_started,omitempty"`
+	LastOptimizeDuration string `json:"last_optimize_duration,omitempty" yaml:"last_optimize_duration,omitempty"`
+	OptimizeResult       string `json:"optimize_result,omitempty" yaml:"optimize_result,omitempty"`
+	UpmapInUse           *bool  `json:"upmap_in_use,omitempty" yaml:"upmap_in_use,omitempty"`
+}
+
+// HealthCheck is an active health check reported by the cluster
+type HealthCheck struct {
+	Code     string `json:"code" yaml:"code"`
+	Severity string `json:"severity" yaml:"severity"`
+	Summary  string `json:"summary" yaml:"summary"`
+}
+
+// CommandRunner runs a command and returns its output. Collection goes
+// through a runner, so commands can be intercepted or replaced
+type CommandRunner interface {
+	Run(commandString string) (string, error)
+}
+
+// execRunner runs commands on the local host, directing ceph commands at
+// the requested cluster
+type execRunner struct {
+	cluster     string
+	id          string
+	cephArgs    []string
+	configData  []byte
+	keyringData []byte
+	timeout     time.Duration
+
+	// ctx ends every command when the collection as a whole is cut short
+	ctx context.Context
+
+	// the config and keyring found in the chosen config directory, which
+	// ceph would not look for itself outside /etc/ceph, under a custom
+	// --keyring-pattern or in keyring-store
+	confFile    string
+	keyringFile string
+
+	// cephadm runs ceph commands in a cephadm shell container, which has
+	// the config and keyring files mounted
+	cephadm      bool
+	cephadmFsid  string
+	cephadmImage string
+}
+
+func (r execRunner) Run(commandString string) (string, error) {
+	var inputs [][]byte
+
+	args := strings.Split(commandString, " ")
+	if args[0] == "ceph" {
+		args = append(args, "--cluster", r.cluster, "--id", r.id)
+		// config and keyring read from an fd are handed on through pipes
+		if r.configData != nil {
+			args = append(args, "--conf", fmt.Sprintf("/dev/fd/%d", 3+len(inputs)))
+			inputs = append(inputs, r.configData)
+		} else if r.confFile != "" && !r.cephadm {
+			// the cephadm shell mounts the files at ceph's default paths
+			args = append(args, "--conf", r.confFile)
+		}
+		if r.keyringData != nil {
+			args = append(args, "--keyring", fmt.Sprintf("/dev/fd/%d", 3+len(inputs)))
+			inputs = append(inputs, r.keyringData)
+		} else if r.keyringFile != "" && !r.cephadm {
+			args = append(args, "--keyring", r.keyringFile)
+		}
+		args = append(args, r.cephArgs...)
+		if r.cephadm {
+			args = append(r.cephadmShell(), args...)
+		}
+	}
+
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	return runCommand(ctx, args, inputs...)
+}
+
+// the cephadm shell invocation that ceph commands run under
+func (r execRunner) cephadmShell() []string {
+	shell := []string{"cephadm"}
+	if r.cephadmImage != "" {
+		shell = append(shell, "--image", r.cephadmImage)
+	}
+	shell = append(shell, "shell")
+	if r.cephadmFsid != "" {
+		shell = append(shell, "--fsid", r.cephadmFsid)
+	}
+	if r.confFile != "" {
+		shell = append(shell, "--config", r.confFile)
+	}
+	if r.keyringFile != "" {
+		shell = append(shell, "--keyring", r.keyringFile)
+	}
+	return append(shell, "--")
+}
+
+// stringList is a flag value that collects each use of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// repeatedString is a string flag that may be given more than once. The last
+// use is its value, and every use is kept in uses
+type repeatedString struct {
+	value *string
+	uses  *[]string
+}
+
+func (r repeatedString) String() string {
+	if r.value == nil {
+		return ""
+	}
+	return *r.value
+}
+
+func (r repeatedString) Set(value string) error {
+	*r.value = value
+	*r.uses = append(*r.uses, value)
+	return nil
+}
+
+// Collector provides site specific fields that are added to the export under
+// the custom key. Collectors are compiled in and added with registerCollector
+type Collector interface {
+	Collect(runner CommandRunner) (map[string]interface{}, error)
+}
+
+// collectors holds the registered custom collectors, by name
+var collectors = map[string]Collector{}
+
+// add a custom collector to the registry, typically from an init function
+func registerCollector(name string, collector Collector) {
+	if _, exists := collectors[name]; exists {
+		panic("collector '" + name + "' is already registered")
+	}
+	collectors[name] = collector
+}
+
+// check for a directory. A missing path is just false, but any other stat
+// failure, such as permission denied, is returned
+func isDir(filePath string) (bool, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, statError(filePath, err)
+	}
+	return info.IsDir(), nil
+}
+
+// check for a file, in the same way as isDir
+func isFile(filePath string) (bool, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, statError(filePath, err)
+	}
+	return !info.IsDir(), nil
+}
+
+// describe a stat failure, naming the path
+func statError(filePath string, err error) error {
+	if os.IsPermission(err) {
+		return errors.New("permission denied reading " + filePath)
+	}
+	return fmt.Errorf("unable to read %s (%s)", filePath, err)
+}
+
+// look for string in a given slice
+func hasString(item string, iterable []string) bool {
+	for _, value := range iterable {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// return a sorted copy of a slice, without duplicates. The copy is never
+// nil, so an empty list is exported as [] rather than null
+func uniqueStrings(items []string) []string {
+	sorted := make([]string, 0, len(items))
+	for _, item := range items {
+		if !hasString(item, sorted) {
+			sorted = append(sorted, item)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// check whether anything is read from the config directory. It isn't needed
+// when everything comes from an fd or the CEPH_CONF and CEPH_KEYRING paths
+func needConfDir(settings *runtimeSettings) bool {
+	needConfig := settings.configData == nil && settings.confPath == ""
+	needKeyring := settings.keyringData == nil && settings.keyringPath == ""
+	return needConfig || needKeyring
+}
+
+// check a config directory holds the config file and a keyring
+func checkConfDir(confDir string, settings *runtimeSettings) error {
+
+	if needConfDir(settings) {
+		found, err := isDir(confDir)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return withHint(errors.New("Directory '"+confDir+"' not found"), "confdir")
+		}
+	}
+
+	if settings.configData == nil {
+		confFile := confFilePath(confDir, settings)
+		found, err := isFile(confFile)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if settings.confPath != "" {
+				return errors.New("CEPH_CONF file " + confFile + " not found")
+			}
+			return withHint(errors.New(path.Base(confFile)+" configuration file missing from "+confDir), "config")
+		}
+	}
+
+	if settings.keyringData != nil {
+		return nil
+	}
+	keyring, err := keyringFilePath(confDir, settings)
+	if keyring == "" && err != nil {
+		return err
+	}
+	if keyring == "" {
+		if settings.keyringPath != "" {
+			return errors.New("CEPH_KEYRING file " + settings.keyringPath + " not found")
+		}
+		return withHint(errors.New("missing keyring/keyring store"), "keyring")
+	}
+
+	return nil
+}
+
+// the cluster's config file, which CEPH_CONF overrides as it does for the
+// ceph commands
+func confFilePath(confDir string, settings *runtimeSettings) string {
+	if settings.confPath != "" {
+		return settings.confPath
+	}
+	return confDir + "/" + settings.cluster + ".conf"
+}
+
+// the candidate keyrings, in the order they're tried. CEPH_KEYRING replaces
+// the keyrings under the config directory
+func keyringCandidates(confDir string, settings *runtimeSettings) []string {
+	if settings.keyringPath != "" {
+		return []string{settings.keyringPath}
+	}
+	return []string{
+		confDir + "/" + fmt.Sprintf(settings.keyringPattern, settings.userName),
+		confDir + "/keyring-store/keyring",
+	}
+}
+
+// the first keyring that exists, or an empty string when there are none.
+// The first keyring that couldn't be checked is reported as the error
+func keyringFilePath(confDir string, settings *runtimeSettings) (string, error) {
+	var firstErr error
+	for _, keyring := range keyringCandidates(confDir, settings) {
+		found, err := isFile(keyring)
+		if found {
+			return keyring, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
+
+// pick the first usable directory when --confdir lists several
+func selectConfDir(settings *runtimeSettings) {
+
+	confDirs := strings.Split(settings.confDir, ",")
+	if len(confDirs) == 1 {
+		return
+	}
+
+	for _, confDir := range confDirs {
+		confDir = strings.TrimSpace(confDir)
+		err := checkConfDir(confDir, settings)
+		if err == nil {
+			logInfo("using the configuration in " + confDir)
+			settings.confDir = confDir
+			return
+		}
+		logDebug(confDir + " is unusable (" + err.Error() + ")")
+	}
+
+	// nothing usable, so let the first directory report the problem
+	settings.confDir = strings.TrimSpace(confDirs[0])
+}
+
+// check if the environment is suitable for the export
+func ready(settings *runtimeSettings) (bool, error) {
+
+	err := checkConfDir(settings.confDir, settings)
+	if err != nil {
+		return false, err
+	}
+
+	command := "ceph"
+	if settings.cephadm {
+		command = "cephadm"
+	}
+	_, err = sendCommand("type " + command)
+	if err != nil {
+		return false, withHint(errors.New(command+" command is unavailable"), "binary")
+	}
+
+	return true, nil
+}
+
+// run the registered collectors, merging their output into a single map.
+// A failing collector is reported, but doesn't stop the export
+func runCollectors(runner CommandRunner) map[string]interface{} {
+
+	var names []string
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	custom := make(map[string]interface{})
+	for _, name := range names {
+		fields, err := collectors[name].Collect(runner)
+		if err != nil {
+			logWarning(fmt.Sprintf("collector '%s' failed (%s)", name, err))
+			continue
+		}
+		for key, value := range fields {
+			if _, exists := custom[key]; exists {
+				logWarning(fmt.Sprintf("collector '%s' overwrites custom field '%s'", name, key))
+			}
+			custom[key] = value
+		}
+	}
+	return custom
+}
+
+// run a ceph command that returns json, and decode the result
+func runJSON(runner CommandRunner, commandString string, result interface{}) error {
+	out, err := runner.Run(commandString)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(out), result)
+}
+
+// add the operational state of the telemetry and balancer modules. Each
+// command may fail independently, leaving its field unset
+func collectOps(runner CommandRunner, exportData *cephMetaData, osdMap *osdDump) {
+
+	var telemetry struct {
+		Enabled bool `json:"enabled"`
+	}
+	err := runJSON(runner, "ceph telemetry status -f json", &telemetry)
+	if err != nil {
+		logWarning("unable to determine telemetry status")
+	} else {
+		exportData.TelemetryEnabled = &telemetry.Enabled
+	}
+
+	// the balancer module is missing from older releases, which leaves the
+	// balancer unset
+	var balancer Balancer
+	err = runJSON(runner, "ceph balancer status -f json", &balancer)
+	if err != nil {
+		logWarning("unable to determine balancer status")
+	} else {
+		exportData.BalancerMode = balancer.Mode
+		exportData.Balancer = &balancer
+		collectUpmap(osdMap, exportData.Balancer)
+	}
+
+	if exportData.DashboardTLS {
+		// certificates set with 'ceph dashboard set-ssl-certificate' are held
+		// in the config-key store, either cluster wide or per mgr
+		var keys []string
+		err = runJSON(runner, "ceph config-key ls -f json", &keys)
+		if err != nil {
+			logWarning("unable to determine whether the dashboard has a custom certificate")
+		} else {
+			customCert := false
+			for _, key := range keys {
+				if strings.HasPrefix(key, "mgr/dashboard/") && strings.HasSuffix(key, "crt") {
+					customCert = true
+				}
+			}
+			exportData.DashboardCustomCert = &customCert
+		}
+	}
+}
+
+// osdDump holds the parts of 'ceph osd dump' used by the optional fields
+type osdDump struct {
+	PGUpmap           []interface{} `json:"pg_upmap"`
+	PGUpmapItems      []interface{} `json:"pg_upmap_items"`
+	FullRatio         float64       `json:"full_ratio"`
+	NearfullRatio     float64       `json:"nearfull_ratio"`
+	BackfillfullRatio float64       `json:"backfillfull_ratio"`
+	RequireOSDRelease string        `json:"require_osd_release"`
+}
+
+// fetch the osdmap, which is nil when it's unavailable so each field that
+// needs it reports its own warning
+func fetchOSDDump(runner CommandRunner) *osdDump {
+	var osdMap osdDump
+	err := runJSON(runner, "ceph osd dump -f json", &osdMap)
+	if err != nil {
+		logDebug("unable to dump the osdmap (" + err.Error() + ")")
+		return nil
+	}
+	return &osdMap
+}
+
+// check for upmap entries in the osdmap, which pin pgs wherever the balancer
+// (or an admin) placed them
+func collectUpmap(osdMap *osdDump, balancer *Balancer) {
+	if osdMap == nil {
+		logWarning("unable to determine whether upmap is in use")
+		return
+	}
+	inUse := len(osdMap.PGUpmap)+len(osdMap.PGUpmapItems) > 0
+	balancer.UpmapInUse = &inUse
+}
+
+// add the first dashboard user with the administrator role. ac-user-show
+// also returns the password hash, which is deliberately not decoded, so no
+// credential can end up in the export
+func collectDashboardUser(runner CommandRunner, exportData *cephMetaData) {
+	var names []string
+	err := runJSON(runner, "ceph dashboard ac-user-show -f json", &names)
+	if err != nil {
+		logWarning("unable to list the dashboard users")
+		return
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var user struct {
+			Username string   `json:"username"`
+			Roles    []string `json:"roles"`
+		}
+		err := runJSON(runner, "ceph dashboard ac-user-show "+name+" -f json", &user)
+		if err != nil {
+			logDebug("unable to show the dashboard user " + name)
+			continue
+		}
+		if hasString("administrator", user.Roles) {
+			exportData.DashboardUser = user.Username
+			return
+		}
+	}
+	logWarning("no dashboard user has the administrator role")
+}
+
+// add the osd full, nearfull and backfillfull ratios from the osdmap
+func collectRatios(osdMap *osdDump, exportData *cephMetaData) {
+	if osdMap == nil {
+		logWarning("unable to determine the osd full ratios")
+		return
+	}
+	exportData.Ratios = &Ratios{
+		Full:         osdMap.FullRatio,
+		Nearfull:     osdMap.NearfullRatio,
+		Backfillfull: osdMap.BackfillfullRatio,
+	}
+}
+
+// add the pg autoscaler state of each pool. autoscale-status is not
+// available on older clusters, so a failure just leaves the field empty
+func collectAutoscale(runner CommandRunner, exportData *cephMetaData) {
+
+	var pools []struct {
+		PoolName string `json:"pool_name"`
+		PgNum    int    `json:"pg_num_target"`
+		PgFinal  int    `json:"pg_num_final"`
+		Mode     string `json:"pg_autoscale_mode"`
+	}
+	err := runJSON(runner, "ceph osd pool autoscale-status -f json", &pools)
+	if err != nil {
+		logWarning("unable to determine the pg autoscaler status")
+		return
+	}
+
+	for _, pool := range pools {
+		exportData.Autoscale = append(exportData.Autoscale, AutoscalePool{
+			Pool:     pool.PoolName,
+			PgNum:    pool.PgNum,
+			PgTarget: pool.PgFinal,
+			Mode:     pool.Mode,
+		})
+	}
+}
+
+// add the count of daemons running each version, by daemon type, so an
+// in progress or stalled upgrade can be seen
+func collectDaemonVersions(runner CommandRunner, exportData *cephMetaData) {
+
+	var versions map[string]map[string]int
+	err := runJSON(runner, "ceph versions -f json", &versions)
+	if err != nil {
+		logWarning("unable to determine the daemon versions")
+		return
+	}
+	exportData.DaemonVersions = versions
 }
 
-// Runtime settings
-type runtimeSettings struct {
-	outFile    string
-	confDir    string
-	fileFormat string
-	userName   string
-}
+// add the minimum releases the osds and mons are held to, which govern
+// compatibility during an upgrade. Either may be missing on an older
+// cluster, leaving its field empty
+func collectReleases(runner CommandRunner, exportData *cephMetaData, osdMap *osdDump) {
+
+	if osdMap == nil {
+		logWarning("unable to determine the required osd release")
+	} else {
+		exportData.RequireOSDRelease = osdMap.RequireOSDRelease
+	}
+
+	var monMap struct {
+		MinMonRelease string `json:"min_mon_release_name"`
+	}
+	err := runJSON(runner, "ceph mon dump -f json", &monMap)
+	if err != nil {
+		logWarning("unable to determine the minimum mon release")
+	} else {
+		exportData.MinMonRelease = monMap.MinMonRelease
+	}
+}
+
+// exit the program with an error message. The message goes to stderr, so it
+// can't be mistaken for an export written to stdout, and os.Exit skips any
+// deferred calls so stdout is synced first
+func abort(message string) {
+	abortWithHint(message, "")
+}
+
+// abort with an error, along with its remediation hint when it has one
+func abortError(err error) {
+	var hinted hintedError
+	if errors.As(err, &hinted) {
+		abortWithHint(err.Error(), hinted.hint)
+	}
+	abort(err.Error())
+}
+
+// abort, suggesting a fix beneath the message unless --no-hints is set
+func abortWithHint(message string, hint string) {
+	if abortHook != nil {
+		abortHook(message)
+	}
+	if noHints {
+		hint = ""
+	}
+	if errorFormat == "json" {
+		exitWithError(exportError{Error: message, Code: 4, Hint: hint})
+	}
+	os.Stdout.Sync()
+	fmt.Fprintf(os.Stderr, "Unable to continue: %s\n", message)
+	if hint != "" {
+		fmt.Fprintf(os.Stderr, "Hint: %s\n", hint)
+	}
+	os.Exit(4)
+}
+
+// noHints leaves the remediation hints off failures, for machine consumers
+var noHints bool
+
+// hintedError is a failure with a known fix, from the doctor's hints
+type hintedError struct {
+	err  error
+	hint string
+}
+
+func (e hintedError) Error() string {
+	return e.err.Error()
+}
+
+func (e hintedError) Unwrap() error {
+	return e.err
+}
+
+// attach the named remediation hint to an error
+func withHint(err error, name string) error {
+	return hintedError{err: err, hint: hints[name]}
+}
+
+// errorFormat is how a failure is reported, text or json
+var errorFormat string
+
+// exportError is a failure reported with --error-format json. The code is
+// also the exit status
+type exportError struct {
+	Error    string   `json:"error"`
+	Code     int      `json:"code"`
+	Warnings []string `json:"warnings,omitempty"`
+	Failures []string `json:"failures,omitempty"`
+	Hint     string   `json:"hint,omitempty"`
+}
+
+// write the failure as a json object on stdout, in place of the export a
+// wrapper would otherwise read there, and exit with its code
+func exitWithError(failure exportError) {
+	encoded, _ := json.Marshal(failure)
+	fmt.Println(string(encoded))
+	os.Stdout.Sync()
+	os.Exit(failure.Code)
+}
+
+// abortHook, when set, is told the reason before abort exits
+var abortHook func(message string)
+
+// debugEnabled turns on the diagnostic messages from logDebug
+var debugEnabled bool
+
+// report diagnostic detail, only shown with --debug
+func logDebug(message string) {
+	if debugEnabled {
+		fmt.Fprintf(os.Stderr, "Debug: %s\n", message)
+	}
+}
+
+// report the choices made on the user's behalf
+func logInfo(message string) {
+	fmt.Fprintf(os.Stderr, "Info: %s\n", message)
+}
+
+// warnings holds every warning reported, for --fail-on-warn. Clusters can be
+// collected concurrently, so it's guarded by warningsLock
+var warnings []string
+var warningsLock sync.Mutex
+
+// report a non-fatal problem with the data being exported
+func logWarning(message string) {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	warnings = append(warnings, message)
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+}
+
+// clear the warnings before a fresh collection. The server collects again and
+// again, and judges each collection by its own warnings
+func resetWarnings() {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	warnings = nil
+}
+
+// the number of warnings reported so far
+func warningCount() int {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	return len(warnings)
+}
+
+// report a data problem, which is only an error when running in strict mode
+func reportInvalid(message string, settings *runtimeSettings) error {
+	if settings.strict {
+		return errors.New(message)
+	}
+	logWarning(message)
+	return nil
+}
+
+// send a command to the OS, and return the response to the caller
+func sendCommand(commandString string) (string, error) {
+	return runCommand(context.Background(), strings.Split(commandString, " "))
+}
+
+// run a command from its individual arguments. Each input is passed to the
+// command through a pipe, starting at fd 3. The command is killed if the
+// context ends first
+func runCommand(ctx context.Context, args []string, inputs ...[]byte) (string, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	for _, input := range inputs {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		go func(data []byte) {
+			writer.Write(data)
+			writer.Close()
+		}(input)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, reader)
+	}
+
+	// timing each command shows which step dominates on a large cluster
+	start := time.Now()
+	out, err := cmd.Output()
+	logDebug(fmt.Sprintf("'%s' took %s", strings.Join(args, " "), time.Since(start).Round(time.Millisecond)))
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", errors.New("command timed out")
+	}
+	if err != nil {
+		return "", errors.New("error running command")
+	}
+	return string(out), nil
+}
+
+// a keyring pattern must hold a single %s verb, for the user name
+func validKeyringPattern(pattern string) bool {
+	return strings.Count(pattern, "%") == 1 && strings.Count(pattern, "%s") == 1
+}
+
+// find the keyring for the given user and return its key, along with where
+// the key was read from
+func fetchKeyring(settings *runtimeSettings) (string, string, error) {
+
+	keyFile, err := keyringFilePath(settings.confDir, settings)
+	if keyFile == "" && settings.keyringData == nil {
+		if err == nil {
+			err = errors.New("no keyring found")
+		}
+		return "", "", withHint(err, "keyring")
+	}
+
+	var source interface{} = keyFile
+	keySource := keyFile
+	if settings.keyringData != nil {
+		source = settings.keyringData
+		keySource = fmt.Sprintf("fd %d", settings.keyringFd)
+	}
+	conf, err := getConfig(source)
+	if err != nil {
+		return "", "", errors.New("unable to read the keyring " + keySource)
+	}
+	keySection := conf.Section("client." + settings.cephID)
+	key, err := keySection.GetKey("key")
+	if err != nil {
+		return "", "", withHint(errors.New("no key for client."+settings.cephID+" in "+keySource), "key")
+	}
+
+	err = validCephxKey(key.String())
+	if err != nil {
+		return "", "", fmt.Errorf("the key for client.%s in %s is malformed (%s)", settings.cephID, keySource, err)
+	}
+	return key.String(), keySource, nil
+}
+
+// check a key has the layout of a cephx secret, base64 of a 2 byte type
+// (1 for AES), an 8 byte creation time, a 2 byte length and the 16 byte
+// secret itself
+func validCephxKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("not valid base64")
+	}
+	if len(raw) != 28 {
+		return fmt.Errorf("%d bytes long rather than 28", len(raw))
+	}
+	if binary.LittleEndian.Uint16(raw[0:2]) != 1 {
+		return errors.New("not an AES key")
+	}
+	if binary.LittleEndian.Uint16(raw[10:12]) != 16 {
+		return errors.New("the secret isn't 16 bytes")
+	}
+	return nil
+}
+
+// print the client identities found in the keyrings of the config
+// directory, and whether each has a usable key
+func listUsers(settings *runtimeSettings) {
+	keyrings, _ := filepath.Glob(settings.confDir + "/" + fmt.Sprintf(settings.keyringPattern, "*"))
+	keyrings = append(keyrings, settings.confDir+"/keyring-store/keyring")
+	if settings.keyringPath != "" {
+		keyrings = []string{settings.keyringPath}
+	}
+
+	found := false
+	for _, keyring := range keyrings {
+		conf, err := getConfig(keyring)
+		if err != nil {
+			continue
+		}
+		for _, section := range conf.Sections() {
+			if !strings.HasPrefix(section.Name(), "client.") {
+				continue
+			}
+			found = true
+			keyStatus := "no key"
+			if section.HasKey("key") && section.Key("key").String() != "" {
+				keyStatus = "key"
+			}
+			fmt.Printf("%-20s %-7s %s\n", strings.TrimPrefix(section.Name(), "client."), keyStatus, keyring)
+		}
+	}
+	if !found {
+		fmt.Println("No client keyrings found in " + settings.confDir)
+	}
+}
+
+// masked stands in for a value print-config won't show
+const masked = "********"
+
+// print the settings the export would run with, once the flags, profile and
+// environment are resolved, then the files they lead to. Credentials in the
+// environment are masked
+func printConfig(fs *flag.FlagSet, settings *runtimeSettings) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if hasString(f.Name, hiddenFlags) {
+			return
+		}
+		value := f.Value.String()
+		if value == "" {
+			value = `""`
+		}
+		if f.Value.String() == f.DefValue {
+			value += " (default)"
+		}
+		fmt.Printf("%-22s %s\n", f.Name, value)
+	})
+
+	fmt.Println()
+	if multiCluster(settings) {
+		targets, _ := clusterTargets(settings)
+		for _, target := range targets {
+			fmt.Printf("%-22s %s in %s\n", "cluster", target.cluster, target.confDir)
+		}
+	} else {
+		keyring, err := keyringFilePath(settings.confDir, settings)
+		if err != nil {
+			keyring = "none (" + err.Error() + ")"
+		}
+		fmt.Printf("%-22s %s\n", "config file", confFilePath(settings.confDir, settings))
+		fmt.Printf("%-22s %s\n", "keyring file", keyring)
+	}
+	if settings.configData != nil {
+		fmt.Printf("%-22s %d bytes from fd %d\n", "config data", len(settings.configData), settings.configFd)
+	}
+	if settings.keyringData != nil {
+		fmt.Printf("%-22s %s\n", "keyring data", masked)
+	}
+
+	for _, name := range []string{"CEPH_CONF", "CEPH_KEYRING", "AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL",
+		"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if name == "AWS_SECRET_ACCESS_KEY" || name == "AWS_SESSION_TOKEN" {
+			value = masked
+		}
+		fmt.Printf("%-22s %s\n", name, value)
+	}
+}
+
+// split a ceph entity address into host and port. Addresses may carry a
+// msgr protocol prefix (v1:, v2:) and a trailing /nonce, and IPv6 hosts are
+// bracketed e.g. v2:[fd00::1]:3300/0
+func splitCephAddr(addr string) (string, string, error) {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "v1:"), "v2:")
+	if idx := strings.LastIndex(addr, "/"); idx >= 0 {
+		addr = addr[:idx]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", "", errors.New("invalid port " + port)
+	}
+	return host, port, nil
+}
+
+// check a mon address is a usable ip and port. An unparseable address is
+// kept in the export unless running in strict mode
+func validateMonAddr(monName interface{}, addr string, settings *runtimeSettings) error {
+	host, _, err := splitCephAddr(addr)
+	if err == nil && net.ParseIP(host) == nil {
+		err = errors.New("not an ip address")
+	}
+	if err != nil {
+		return reportInvalid(fmt.Sprintf("mon.%v address '%s' is invalid (%s)", monName, addr, err), settings)
+	}
+	return nil
+}
+
+// simplistic hstname check -if ir starts with a number, it's an IP address!
+func isIP(hostName string) bool {
+	char1 := string(hostName[0])
+	_, err := strconv.ParseInt(char1, 10, 8)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// parse a url reported by ceph, adding a scheme if it's missing, and return
+// it in a consistent form
+func normalizeURL(rawURL string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", errors.New("no host in url")
+	}
+	return u.String(), nil
+}
+
+// validate a service url, keeping the raw value if it can't be parsed
+func cleanURL(svcName string, rawURL string, settings *runtimeSettings) (string, error) {
+	cleaned, err := normalizeURL(rawURL)
+	if err != nil {
+		message := fmt.Sprintf("%s url '%s' is invalid (%s)", svcName, rawURL, err)
+		return rawURL, reportInvalid(message, settings)
+	}
+	return cleaned, nil
+}
+
+// strip the --trim-domain suffix from a hostname. Names in other domains,
+// and addresses, are returned unchanged
+func trimDomain(hostName string, settings *runtimeSettings) string {
+	if settings.trimDomain == "" || isIP(hostName) {
+		return hostName
+	}
+	suffix := "." + strings.TrimPrefix(settings.trimDomain, ".")
+	if strings.HasSuffix(hostName, suffix) && len(hostName) > len(suffix) {
+		return strings.TrimSuffix(hostName, suffix)
+	}
+	return hostName
+}
+
+// convert a daemon name to an address. When the name can't be resolved it's
+// kept, less any trimmed domain
+func resolveName(name string, settings *runtimeSettings) string {
+	if isIP(name) {
+		return name
+	}
+	ip, err := net.LookupHost(name)
+	if err == nil {
+		return pickAddress(ip, settings.addressFamily)
+	}
+	return trimDomain(name, settings)
+}
+
+// choose one of a lookup's addresses. The order of a lookup isn't stable,
+// so the addresses are sorted and the first of the preferred family is
+// used, or the first of any family when there are none
+func pickAddress(addrs []string, family string) string {
+	sorted := uniqueStrings(addrs)
+	for _, addr := range sorted {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if (family == "ipv4") == (ip.To4() != nil) {
+			return addr
+		}
+	}
+	return sorted[0]
+}
+
+// Read a ceph confg (ini) format, from a filename or the content itself
+func getConfig(source interface{}) (*ini.File, error) {
+	cfg, err := ini.Load(source)
+	if err != nil {
+		return cfg, errors.New("Unable to load the config file")
+	}
+	return cfg, nil
+}
+
+// read a [global] option, which ceph accepts with spaces or underscores
+func globalOption(conf *ini.File, name string) string {
+	global := conf.Section("global")
+	for _, key := range []string{name, strings.Replace(name, "_", " ", -1)} {
+		if global.HasKey(key) {
+			return strings.TrimSpace(global.Key(key).String())
+		}
+	}
+	return ""
+}
+
+// the hosts of a mon_host setting, which may be a plain list or hold
+// address vectors e.g. [v2:10.0.0.1:3300,v1:10.0.0.1:6789],[v2:...]
+func monHostHosts(monHost string) []string {
+	var hosts []string
+	fields := strings.FieldsFunc(monHost, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '[' || r == ']'
+	})
+	for _, field := range fields {
+		host, _, err := splitCephAddr(field)
+		if err != nil {
+			host = field
+		}
+		hosts = append(hosts, host)
+	}
+	return uniqueStrings(hosts)
+}
+
+// add what only the local config holds, the networks, and check the rest
+// of it agrees with the running cluster
+func applyLocalConfig(exportData *cephMetaData, settings *runtimeSettings) {
+	// the display name is --cluster-label, then the label in the config,
+	// then the cluster name
+	exportData.ClusterName = settings.clusterLabel
+	if exportData.ClusterName == "" {
+		exportData.ClusterName = settings.cluster
+	}
+
+	var source interface{} = confFilePath(settings.confDir, settings)
+	if settings.configData != nil {
+		source = settings.configData
+	}
+	conf, err := getConfig(source)
+	if err != nil {
+		logDebug("unable to read the local config")
+		return
+	}
+
+	if label := globalOption(conf, settings.clusterLabelKey); label != "" && settings.clusterLabel == "" {
+		exportData.ClusterName = label
+	}
+	exportData.PublicNetwork = globalOption(conf, "public_network")
+	exportData.ClusterNetwork = globalOption(conf, "cluster_network")
+	crossCheckConfig(conf, exportData)
+}
+
+// compare the fsid and mons in the local config with those of the running
+// cluster. A mismatch means the config is stale or for another cluster, so
+// it's only worth a warning
+func crossCheckConfig(conf *ini.File, exportData *cephMetaData) {
+	fsid := globalOption(conf, "fsid")
+	if fsid != "" && fsid != exportData.Fsid {
+		logWarning("the local config's fsid " + fsid + " doesn't match the cluster's " + exportData.Fsid)
+	}
+
+	var liveHosts []string
+	for _, mon := range exportData.Mons {
+		host, _, err := splitCephAddr(mon)
+		if err == nil {
+			liveHosts = append(liveHosts, host)
+		}
+	}
+	for _, host := range monHostHosts(globalOption(conf, "mon_host")) {
+		// only addresses can be compared, a name could resolve to anything
+		if net.ParseIP(host) == nil {
+			logDebug("not cross checking mon_host entry " + host)
+			continue
+		}
+		if !hasString(host, liveHosts) {
+			logWarning("mon_host entry " + host + " in the local config isn't a mon of the cluster")
+		}
+	}
+}
+
+// check whether stdin is attached to a terminal
+func isTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// ask the user whether an existing file may be overwritten. Without a
+// terminal there is nobody to ask, so only --yes allows the overwrite
+func confirmOverwrite(fileName string, settings *runtimeSettings) bool {
+	if settings.assumeYes {
+		return true
+	}
+	if !isTerminal() {
+		fmt.Fprintln(os.Stderr, "Use --force or --yes to overwrite an existing file")
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%s already exists. Overwrite? [y/N] ", fileName)
+	reader := bufio.NewReader(os.Stdin)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// check for a named pipe or a character/block device
+func isSpecialFile(filePath string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false
+	}
+	return info.Mode()&(os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// stream the export to a pipe or device. There's no file to replace, so the
+// overwrite checks don't apply
+func writeSpecialFile(fileName string, output []byte, settings *runtimeSettings) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = file.Write(output)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return errors.New("Failed to write to " + fileName + " (" + err.Error() + ")")
+	}
+	fmt.Fprintln(settings.progress, "\nMetadata written to "+fileName)
+	return nil
+}
+
+// extensions that mark an --output name as already complete
+var knownExtensions = []string{".json", ".ndjson", ".yaml", ".yml", ".gpg"}
+
+// add the --ext extension (by default the format's own) to an output name,
+// unless it already ends in one. An encrypted export also ends in .gpg
+func withExtension(name string, settings *runtimeSettings) string {
+	name = withFormatExtension(name, settings)
+	if len(settings.gpgRecipients) > 0 && !strings.HasSuffix(name, ".gpg") {
+		name += ".gpg"
+	}
+	return name
+}
+
+func withFormatExtension(name string, settings *runtimeSettings) string {
+	ext := settings.ext
+	switch ext {
+	case "":
+		// a template's output could be anything, so it gets no extension
+		if settings.templateFile != "" || settings.templateName != "" {
+			return name
+		}
+		ext = outputFormats[settings.fileFormat].extension
+	case "none":
+		return name
+	}
+	ext = "." + strings.TrimPrefix(ext, ".")
+
+	if strings.HasSuffix(name, ext) || hasString(path.Ext(name), knownExtensions) {
+		return name
+	}
+	return name + ext
+}
+
+// exportedAtPattern matches the exported_at field in any of the formats
+var exportedAtPattern = regexp.MustCompile(`"?exported_at"?\s*:\s*"?[0-9TZ:.+-]*"?,?`)
+
+// drop the export timestamp, which changes on every run, so two exports can
+// be compared on their content
+func withoutTimestamp(export []byte) []byte {
+	return exportedAtPattern.ReplaceAll(export, nil)
+}
+
+// export to a file, or to stdout when the output is -
+func writeFile(output []byte, settings *runtimeSettings) error {
+	if int64(len(output)) > settings.maxOutputSize {
+		return fmt.Errorf("export is %d bytes, exceeding the --max-output-size of %d bytes", len(output), settings.maxOutputSize)
+	}
+
+	if settings.outFile == "-" {
+		// end the document's last line, for line based readers and the
+		// shell prompt. An encrypted export is binary, and left as it is
+		if len(settings.gpgRecipients) == 0 && !bytes.HasSuffix(output, []byte("\n")) {
+			output = append(output, '\n')
+		}
+		os.Stdout.Write(output)
+		return nil
+	}
+
+	if strings.HasPrefix(settings.outFile, "~") {
+		usr, _ := user.Current()
+		settings.outFile = strings.Replace(settings.outFile, "~", usr.HomeDir, 1)
+	}
+	fileName := withExtension(settings.outFile, settings)
+
+	// pipes and devices are written as given, with no extension added
+	if isSpecialFile(settings.outFile) {
+		fileName = settings.outFile
+	}
+	if isSpecialFile(fileName) {
+		return writeSpecialFile(fileName, output, settings)
+	}
+
+	// leaving an unchanged file alone keeps its mtime, so nothing watching
+	// it reloads for no reason
+	if settings.onlyIfChanged {
+		current, err := ioutil.ReadFile(fileName)
+		if err == nil && bytes.Equal(withoutTimestamp(current), withoutTimestamp(output)) {
+			logInfo("no change to " + fileName)
+			return nil
+		}
+	}
+
+	// a file that can't be checked will fail in the write, with the reason
+	exists, _ := isFile(fileName)
+	if exists && !settings.force && !confirmOverwrite(fileName, settings) {
+		return errors.New("Output file " + fileName + " already exists")
+	}
+
+	err := ioutil.WriteFile(fileName, output, 0644)
+	if err != nil {
+		return errors.New("Failed to write " + fileName + " (" + err.Error() + ")")
+	}
+	err = setOwner(fileName, settings)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(settings.progress, "\nMetadata written to "+fileName)
+	return nil
+}
+
+// resolve a user or group given by name or numeric id, returning -1 when
+// none is given
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// hand a written file to the --output-owner and --output-group
+func setOwner(fileName string, settings *runtimeSettings) error {
+	if settings.ownerID < 0 && settings.groupID < 0 {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		logWarning("file ownership can't be changed on " + runtime.GOOS + ", leaving " + fileName + " as written")
+		return nil
+	}
+
+	err := os.Chown(fileName, settings.ownerID, settings.groupID)
+	if os.IsPermission(err) {
+		return errors.New("not permitted to change the owner of " + fileName + ", which needs root or CAP_CHOWN")
+	}
+	if err != nil {
+		return errors.New("Unable to change the owner of " + fileName + " (" + err.Error() + ")")
+	}
+	return nil
+}
+
+// the serialized name of a metadata field, taken from its json tag
+func fieldName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// the serialized names of all the metadata fields
+func allFieldNames() []string {
+	var names []string
+	metaType := reflect.TypeOf(cephMetaData{})
+	for i := 0; i < metaType.NumField(); i++ {
+		names = append(names, fieldName(metaType.Field(i)))
+	}
+	return names
+}
+
+// the fields to leave out of the export
+func excludedFields(settings *runtimeSettings) []string {
+	var excluded []string
+	for _, item := range settings.exclude {
+		excluded = append(excluded, strings.Split(item, ",")...)
+	}
+	if settings.noSecret {
+		excluded = append(excluded, "secret")
+	}
+	return excluded
+}
+
+// check every --require-field was given a value by the collection
+func checkRequiredFields(content *cephMetaData, settings *runtimeSettings) error {
+	value := reflect.ValueOf(content).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := fieldName(value.Type().Field(i))
+		if hasString(name, settings.requireFields) && isEmpty(value.Field(i)) {
+			return errors.New("the required field " + name + " has no value")
+		}
+	}
+	return nil
+}
+
+// mask the fields selected for redaction, and encode the secret as
+// --secret-format asks, in a copy of the metadata
+func redactMetadata(content *cephMetaData, settings *runtimeSettings) *cephMetaData {
+	encodeSecret := settings.secretFormat == "base64" && content.Secret != ""
+	if !settings.redactURLs && !settings.redactNetworks && !encodeSecret {
+		return content
+	}
+
+	var fields []*string
+	masked := *content
+	if encodeSecret {
+		masked.Secret = base64.StdEncoding.EncodeToString([]byte(content.Secret))
+	}
+	if settings.redactURLs {
+		fields = append(fields, &masked.DashboardURL, &masked.PrometheusURL)
+	}
+	if settings.redactNetworks {
+		fields = append(fields, &masked.PublicNetwork, &masked.ClusterNetwork)
+	}
+	for _, field := range fields {
+		if *field != "" {
+			*field = redacted
+		}
+	}
+	return &masked
+}
+
+// add an option to one of a field's tags e.g. yaml:"mons" to yaml:"mons,flow"
+func addTagOption(tag reflect.StructTag, key string, option string) reflect.StructTag {
+	value, ok := tag.Lookup(key)
+	if !ok {
+		return tag
+	}
+	old := fmt.Sprintf("%s:%q", key, value)
+	updated := fmt.Sprintf("%s:%q", key, value+","+option)
+	return reflect.StructTag(strings.Replace(string(tag), old, updated, 1))
+}
+
+// remove an option from one of a field's tags, the reverse of addTagOption
+func removeTagOption(tag reflect.StructTag, key string, option string) reflect.StructTag {
+	value, ok := tag.Lookup(key)
+	if !ok {
+		return tag
+	}
+	old := fmt.Sprintf("%s:%q", key, value)
+	updated := fmt.Sprintf("%s:%q", key, strings.Replace(value, ","+option, "", 1))
+	return reflect.StructTag(strings.Replace(string(tag), old, updated, 1))
+}
+
+// copy the metadata into a struct type built without the excluded fields,
+// so they're dropped entirely rather than emptied. The same copy carries any
+// tag changes, such as flow style lists in yaml
+func fieldView(content *cephMetaData, settings *runtimeSettings) interface{} {
+
+	excluded := excludedFields(settings)
+	if len(excluded) == 0 && !settings.compactSlices && !settings.omitemptyOff {
+		return content
+	}
+
+	src := reflect.ValueOf(content).Elem()
+	var fields []reflect.StructField
+	var values []reflect.Value
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		if hasString(fieldName(field), excluded) {
+			continue
+		}
+		if settings.compactSlices && field.Type == reflect.TypeOf([]string{}) {
+			field.Tag = addTagOption(field.Tag, "yaml", "flow")
+		}
+		if settings.omitemptyOff {
+			field.Tag = removeTagOption(field.Tag, "json", "omitempty")
+			field.Tag = removeTagOption(field.Tag, "yaml", "omitempty")
+		}
+		fields = append(fields, field)
+		values = append(values, src.Field(i))
+	}
+
+	view := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, value := range values {
+		view.Field(i).Set(value)
+	}
+	return view.Interface()
+}
+
+// build the value to serialize, with redaction, field selection and any
+// --wrap key applied
+func exportView(content *cephMetaData, settings *runtimeSettings) interface{} {
+
+	view := fieldView(redactMetadata(content, settings), settings)
+	if settings.wrap != "" {
+		return map[string]interface{}{settings.wrap: view}
+	}
+	return view
+}
+
+// dump to json. encoding/json (like yaml.v2) writes map keys in sorted order,
+// so map fields such as custom are already stable without an ordered
+// intermediate
+func toJSON(content interface{}, indent string) []byte {
+
+	out, err := json.MarshalIndent(content, "", indent)
+	if err != nil {
+		abort("Export to json failed")
+	}
+	return out
+}
+
+// dump to newline delimited json, a single compact object per line
+func toNDJSON(content interface{}) []byte {
+
+	out, err := json.Marshal(content)
+	if err != nil {
+		abort("Export to ndjson failed")
+	}
+	return append(out, '\n')
+}
+
+// dump to yaml
+func toYAML(content interface{}) []byte {
+
+	out := []byte("---\n")
+	yaml, err := yaml.Marshal(content)
+	if err != nil {
+		abort("Export to yaml failed")
+	}
+	return append(out, yaml...)
+}
+
+// outputFormat describes a --format, and how the metadata is rendered in it
+type outputFormat struct {
+	description string
+	contentType string
+	extension   string
+	render      func(content *cephMetaData, settings *runtimeSettings) []byte
+}
+
+// outputFormats holds every supported --format, by name
+var outputFormats = map[string]outputFormat{
+	"json": {
+		description: "indented json document",
+		contentType: "application/json",
+		extension:   "json",
+		render: func(content *cephMetaData, settings *runtimeSettings) []byte {
+			return toJSON(exportView(content, settings), settings.indent)
+		},
+	},
+	"ndjson": {
+		description: "single line of json, for streaming ingestion",
+		contentType: "application/x-ndjson",
+		extension:   "ndjson",
+		render: func(content *cephMetaData, settings *runtimeSettings) []byte {
+			return toNDJSON(exportView(content, settings))
+		},
+	},
+	"yaml": {
+		description: "yaml document",
+		contentType: "application/yaml",
+		extension:   "yaml",
+		render: func(content *cephMetaData, settings *runtimeSettings) []byte {
+			return toYAML(exportView(content, settings))
+		},
+	},
+	"k8s-split": {
+		description: "kubernetes ConfigMap of the metadata, and a Secret of the key",
+		contentType: "application/yaml",
+		extension:   "yaml",
+		render:      toK8sSplit,
+	},
+	"grafana-datasource": {
+		description: "grafana datasource for the prometheus url, in json",
+		contentType: "application/json",
+		extension:   "json",
+		render:      toGrafanaDatasource,
+	},
+}
+
+// extensionFormats gives the format of an --output name, for --format auto
+var extensionFormats = map[string]string{
+	".json":   "json",
+	".ndjson": "ndjson",
+	".yaml":   "yaml",
+	".yml":    "yaml",
+}
+
+// the names of the supported formats, sorted
+func formatNames() []string {
+	var names []string
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// print the supported formats, for --format list
+func listFormats() {
+	width := 0
+	for _, name := range formatNames() {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for _, name := range formatNames() {
+		fmt.Printf("%-*s  %s\n", width, name, outputFormats[name].description)
+	}
+}
+
+// write ceph facts to a file
+func exportMetadata(content *cephMetaData, settings *runtimeSettings) error {
+
+	// fmt.Println(*content)
+	// fmt.Println(*settings)
+	recordProvenance(content, settings)
+
+	var out []byte
+	if settings.templateFile != "" || settings.templateName != "" {
+		out = renderTemplate(content, settings)
+	} else {
+		out = outputFormats[settings.fileFormat].render(content, settings)
+	}
+	if len(settings.gpgRecipients) > 0 {
+		var err error
+		out, err = encryptGPG(out, settings)
+		if err != nil {
+			return err
+		}
+	}
+	if settings.outFile != "" {
+		err := writeFile(out, settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if settings.s3Bucket != "" {
+		err := uploadS3(out, settings)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(settings.progress, "\nMetadata uploaded to s3://%s/%s\n", settings.s3Bucket, settings.s3Key)
+	}
+
+	if settings.k8sApply {
+		fmt.Fprintln(settings.progress)
+		err := applyK8s(content, settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if settings.socket != "" {
+		err := writeSocket(out, settings)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(settings.progress, "\nMetadata sent to "+settings.socket)
+	}
+
+	return nil
+}
+
+// add the command line flags that control connecting to the cluster and
+// collecting its metadata, which every command that collects shares
+func addFlags(fs *flag.FlagSet, settings *runtimeSettings) {
+	settings.confDir = defaults["confDir"]
+	fs.Var(repeatedString{&settings.confDir, &settings.confDirs}, "confdir", "Ceph configuration directory, or a comma separated list to search (repeat to export several clusters)")
+	fs.StringVar(&settings.userName, "user", defaults["userName"], "user keyring")
+	fs.StringVar(&settings.cephID, "id", "", "cephx id for ceph commands and the keyring lookup (defaults to --user)")
+	settings.cluster = defaults["cluster"]
+	fs.Var(repeatedString{&settings.cluster, &settings.clusters}, "cluster", "ceph cluster name (repeat to export several clusters)")
+	fs.StringVar(&settings.clusterLabel, "cluster-label", "", "display name for the cluster (defaults to the config's label, then the cluster name)")
+	fs.StringVar(&settings.clusterLabelKey, "cluster-label-key", defaults["clusterLabelKey"], "[global] option in the config that holds the cluster's display name")
+	fs.Var((*stringList)(&settings.cephArgs), "ceph-arg", "extra argument passed to every ceph command (repeatable)")
+	fs.StringVar(&settings.keyringPattern, "keyring-pattern", defaults["keyringPattern"], "keyring filename pattern, with %s for the user name")
+	fs.BoolVar(&settings.cephadm, "cephadm", false, "run the ceph commands through 'cephadm shell', for containerized clusters")
+	fs.StringVar(&settings.cephadmFsid, "cephadm-fsid", "", "fsid of the cluster to run the cephadm shell for, which also adds its config directory to --confdir")
+	fs.StringVar(&settings.cephadmImage, "cephadm-image", "", "container image for the cephadm shell")
+	fs.IntVar(&settings.configFd, "config-fd", -1, "read the ceph config from an inherited file descriptor")
+	fs.IntVar(&settings.keyringFd, "keyring-fd", -1, "read the keyring from an inherited file descriptor")
+	fs.StringVar(&settings.addressFamily, "address-family", defaults["addressFamily"], "address family preferred when a name resolves to several addresses (ipv4 or ipv6)")
+	fs.StringVar(&settings.trimDomain, "trim-domain", "", "domain suffix to remove from exported hostnames")
+	fs.StringVar(&settings.profile, "profile", "", "preset of flags: share (no-secret, redact-urls, redact-networks), full (all optional data), client (only fsid, mons, mon_v2, secret and version)")
+	fs.Var((*stringList)(&settings.requireFields), "require-field", "fail the export when this field has no value (repeatable)")
+	fs.BoolVar(&settings.requireDash, "require-dashboard", false, "fail the export when the mgr publishes no dashboard url, as --require-field dashboard_url")
+	fs.Var((*stringList)(&settings.exclude), "exclude", "field to leave out of the export (repeatable)")
+	fs.BoolVar(&settings.noSecret, "no-secret", false, "leave the secret out of the export")
+	fs.StringVar(&settings.secretFormat, "secret-format", defaults["secretFormat"], "how the secret is written, raw or base64 encoded")
+	fs.BoolVar(&settings.noHostname, "no-hostname", false, "leave out the name of the host the export ran on")
+	fs.BoolVar(&settings.redactNetworks, "redact-networks", false, "mask the public and cluster networks, which reveal the network layout")
+	fs.BoolVar(&settings.redactURLs, "redact-urls", false, "mask the service urls, which reveal internal hostnames")
+	fs.BoolVar(&settings.strict, "strict", false, "treat invalid cluster data as an error")
+	fs.BoolVar(&settings.failOnWarn, "fail-on-warn", false, "exit with status 5, writing nothing, if the collection raised any warning")
+	fs.BoolVar(&settings.includeOps, "include-ops", false, "include telemetry, balancer, upmap, osd full ratio and dashboard certificate status (runs ceph telemetry status, ceph balancer status, ceph osd dump and ceph config-key ls)")
+	fs.BoolVar(&settings.includePools, "include-pools", false, "include the pg autoscaler status of each pool and the osd full ratios (runs ceph osd pool autoscale-status and ceph osd dump)")
+	fs.BoolVar(&settings.includeAll, "include-all", false, "include all the optional data, running every extra command of the --include options")
+	fs.BoolVar(&settings.noOps, "no-ops", false, "leave out the --include-ops data, with --include-all")
+	fs.BoolVar(&settings.noPools, "no-pools", false, "leave out the --include-pools data, with --include-all")
+	fs.BoolVar(&settings.noReleases, "no-releases", false, "leave out the --include-releases data, with --include-all")
+	fs.BoolVar(&settings.noVersions, "no-versions", false, "leave out the --include-versions data, with --include-all")
+	fs.StringVar(&settings.healthMinSeverity, "health-min-severity", "", "only export health checks of this severity or worse (warn or error)")
+	fs.StringVar(&settings.onUnhealthy, "on-unhealthy", defaults["onUnhealthy"], "action when the cluster is in HEALTH_ERR (proceed, warn or abort)")
+	fs.BoolVar(&settings.omitemptyOff, "omitempty-off", false, "write every field, including optional ones with no value")
+	fs.StringVar(&settings.wrap, "wrap", "", "nest the export under this top level key")
+	fs.StringVar(&settings.jsonIndent, "json-indent", defaults["jsonIndent"], "json indentation, as a number of spaces or tab")
+	fs.DurationVar(&settings.timeout, "timeout", 0, "limit on each ceph command and upload, e.g. 30s (0 for no limit)")
+	fs.DurationVar(&settings.collectTimeout, "collect-timeout", 0, "limit on the whole collection, across every command and lookup (0 for no limit)")
+	fs.IntVar(&settings.parallel, "parallel", 4, "clusters collected at once, when exporting several")
+	fs.BoolVar(&settings.verifyEndpoints, "verify-endpoints", false, "check the dashboard and prometheus urls answer, recording the result")
+	fs.BoolVar(&settings.withProvenance, "with-provenance", false, "record the command each exported field came from, under _provenance")
+	fs.StringVar(&settings.captureDir, "capture-dir", "", "save the raw output of each ceph command in this directory, e.g. for a bug report")
+	fs.BoolVar(&settings.includeDashboardUser, "include-dashboard-user", false, "include the name of the dashboard's administrator user, never its password (runs ceph dashboard ac-user-show)")
+	fs.BoolVar(&settings.includeVersions, "include-versions", false, "include the versions running on each daemon type (runs ceph versions)")
+	fs.BoolVar(&settings.includeReleases, "include-releases", false, "include the required osd and minimum mon releases (runs ceph osd dump and ceph mon dump)")
+	fs.BoolVar(&debugEnabled, "debug", false, "show diagnostic messages")
+	fs.BoolVar(&noHints, "no-hints", false, "leave the suggested fix off a failure")
+	fs.StringVar(&errorFormat, "error-format", defaults["errorFormat"], "how a failure is reported, text on stderr or a json object on stdout")
+}
+
+// add the command line flags that control how the export is written and
+// where it goes, which only the export itself takes
+func addOutputFlags(fs *flag.FlagSet, settings *runtimeSettings) {
+	fs.StringVar(&settings.outFile, "output", defaults["outFile"], "output file name, or - for stdout")
+	fs.StringVar(&settings.fileFormat, "format", defaults["fileFormat"], "output file format, or auto to use the --output extension (list shows the supported formats)")
+	fs.StringVar(&settings.k8sName, "k8s-name", defaults["k8sName"], "name of the ConfigMap and Secret, with --format k8s-split or --k8s-apply")
+	fs.StringVar(&settings.k8sNamespace, "k8s-namespace", "", "namespace of the ConfigMap and Secret, with --format k8s-split or --k8s-apply")
+	fs.BoolVar(&settings.k8sApply, "k8s-apply", false, "create or update the ConfigMap and Secret with kubectl, using its kubeconfig or in-cluster account")
+	fs.StringVar(&settings.templateFile, "template", "", "render the export through this go text/template file, instead of --format")
+	fs.StringVar(&settings.templateName, "template-name", "", "render the export through a built in template ("+strings.Join(templateNames(), ", ")+")")
+	fs.StringVar(&settings.ext, "ext", "", "extension added to the output file, or none (defaults to the format name)")
+	fs.BoolVar(&settings.syslog, "syslog", false, "record the outcome of the export in the local syslog")
+	fs.StringVar(&settings.syslogFacility, "syslog-facility", defaults["syslogFacility"], "syslog facility, e.g. user, daemon or local0")
+	fs.StringVar(&settings.syslogTag, "syslog-tag", defaults["syslogTag"], "syslog tag")
+	fs.BoolVar(&settings.compactSlices, "compact-slices", false, "write lists on a single line in yaml e.g. [a, b, c]")
+	fs.Var((*stringList)(&settings.gpgRecipients), "gpg-recipient", "encrypt the whole export with gpg for this recipient, writing a .gpg file (repeatable)")
+	fs.StringVar(&settings.s3Bucket, "s3-bucket", "", "upload the export to this S3 bucket, using the AWS_* environment for the endpoint and credentials")
+	fs.StringVar(&settings.s3Key, "s3-key", "", "object key for the S3 upload (defaults to the output file name)")
+	fs.StringVar(&settings.socket, "socket", "", "send the export to the collector listening on this unix socket")
+	fs.StringVar(&settings.outputOwner, "output-owner", "", "user name or id to own the written file")
+	fs.StringVar(&settings.outputGroup, "output-group", "", "group name or id to own the written file")
+	fs.StringVar(&settings.umask, "umask", "", "octal umask for the files and directories written, e.g. 077 (defaults to the inherited umask)")
+	fs.Int64Var(&settings.maxOutputSize, "max-output-size", defaultMaxOutputSize, "largest export to write, in bytes")
+	fs.BoolVar(&settings.onlyIfChanged, "only-if-changed", false, "leave the output file untouched when the export is unchanged")
+	fs.BoolVar(&settings.force, "force", false, "overwrite an existing output file")
+	fs.BoolVar(&settings.assumeYes, "yes", false, "answer yes to the overwrite prompt")
+}
+
+// hiddenFlags are left out of the usage text
+var hiddenFlags = []string{"self-test"}
+
+// build a usage function for a flag set that skips the hidden flags
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		visible.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !hasString(f.Name, hiddenFlags) {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		visible.PrintDefaults()
+	}
+}
+
+// clientFields are the fields a ceph client needs to connect
+var clientFields = []string{"fsid", "mons", "mon_v2", "secret", "version"}
+
+// return the flag values a --profile implies
+func profileFlags(profile string) (map[string]string, error) {
+	switch profile {
+	case "":
+		return nil, nil
+	case "share":
+		return map[string]string{"no-secret": "true", "redact-urls": "true", "redact-networks": "true"}, nil
+	case "full":
+		return map[string]string{"include-all": "true"}, nil
+	case "client":
+		var excluded []string
+		for _, name := range allFieldNames() {
+			if !hasString(name, clientFields) {
+				excluded = append(excluded, name)
+			}
+		}
+		return map[string]string{"exclude": strings.Join(excluded, ",")}, nil
+	}
+	return nil, errors.New("unknown profile '" + profile + "', use share, full or client")
+}
+
+// set the flags implied by --profile, leaving any given explicitly alone
+func applyProfile(fs *flag.FlagSet, settings *runtimeSettings) {
+	presets, err := profileFlags(settings.profile)
+	if err != nil {
+		abort(err.Error())
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range presets {
+		if !explicit[name] {
+			fs.Set(name, value)
+		}
+	}
+}
+
+// resolve settings that depend on each other, once the flags are parsed
+func prepareSettings(fs *flag.FlagSet, settings *runtimeSettings) {
+	// checked first, so any later failure is reported in the chosen form
+	if !hasString(errorFormat, []string{"text", "json"}) {
+		errorFormat = "text"
+		abort("--error-format must be text or json")
+	}
+	applyProfile(fs, settings)
+	if settings.includeAll {
+		settings.includeOps = !settings.noOps
+		settings.includePools = !settings.noPools
+		settings.includeVersions = !settings.noVersions
+		settings.includeReleases = !settings.noReleases
+	}
+	if settings.cephID == "" {
+		settings.cephID = settings.userName
+	}
+	for _, name := range excludedFields(settings) {
+		if !hasString(name, allFieldNames()) {
+			abort("unknown field '" + name + "' in --exclude")
+		}
+	}
+	if settings.requireDash {
+		settings.requireFields = append(settings.requireFields, "dashboard_url")
+	}
+	for _, name := range settings.requireFields {
+		if !hasString(name, allFieldNames()) {
+			abort("unknown field '" + name + "' in --require-field")
+		}
+	}
+
+	if multiCluster(settings) {
+		checkMultiCluster(settings)
+	} else {
+		settings.keyringPattern = clusterKeyringPattern(settings.keyringPattern, settings.cluster)
+	}
+	if !validKeyringPattern(settings.keyringPattern) {
+		abort("keyring pattern '" + settings.keyringPattern + "' must contain a single %s")
+	}
+	if !hasString(settings.secretFormat, []string{"raw", "base64"}) {
+		abort("--secret-format must be raw or base64")
+	}
+	if !hasString(settings.addressFamily, []string{"ipv4", "ipv6"}) {
+		abort("--address-family must be ipv4 or ipv6")
+	}
+	if _, ok := healthSeverities[settings.healthMinSeverity]; settings.healthMinSeverity != "" && !ok {
+		abort("--health-min-severity must be warn or error")
+	}
+	if !hasString(settings.onUnhealthy, []string{"proceed", "warn", "abort"}) {
+		abort("--on-unhealthy must be one of proceed, warn or abort")
+	}
+
+	if settings.jsonIndent == "tab" {
+		settings.indent = "\t"
+	} else {
+		spaces, err := strconv.Atoi(settings.jsonIndent)
+		if err != nil || spaces < 0 {
+			abort("--json-indent must be a number of spaces or tab")
+		}
+		settings.indent = strings.Repeat(" ", spaces)
+	}
+
+	// honour the same environment overrides as the ceph commands
+	settings.confPath = os.Getenv("CEPH_CONF")
+	settings.keyringPath = os.Getenv("CEPH_KEYRING")
+
+	if settings.cephadm {
+		if settings.configFd >= 0 || settings.keyringFd >= 0 {
+			abort("--config-fd and --keyring-fd can't be passed into a --cephadm shell")
+		}
+		// cephadm keeps a copy of the config and keyring for each cluster
+		// under /var/lib/ceph, which is searched after the --confdir
+		if settings.cephadmFsid != "" {
+			settings.confDir += ",/var/lib/ceph/" + settings.cephadmFsid + "/config"
+		}
+	}
+
+	if settings.configFd >= 0 {
+		settings.configData = readFd(settings.configFd, "config")
+	}
+	if settings.keyringFd >= 0 {
+		settings.keyringData = readFd(settings.keyringFd, "keyring")
+	}
+
+	// each cluster's confdir is searched as it's collected
+	if !multiCluster(settings) {
+		selectConfDir(settings)
+	}
+}
+
+// resolve the settings for writing the export, once the flags added by
+// addOutputFlags are parsed
+func prepareOutput(fs *flag.FlagSet, settings *runtimeSettings) {
+	var err error
+	settings.ownerID, err = lookupID(settings.outputOwner, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		abort("unknown --output-owner '" + settings.outputOwner + "'")
+	}
+	settings.groupID, err = lookupID(settings.outputGroup, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		abort("unknown --output-group '" + settings.outputGroup + "'")
+	}
+
+	// --format JSON is as good as --format json
+	settings.fileFormat = strings.ToLower(strings.TrimSpace(settings.fileFormat))
+	explicitFormat := false
+	fs.Visit(func(f *flag.Flag) {
+		explicitFormat = explicitFormat || f.Name == "format"
+	})
+	if settings.fileFormat == "auto" || !explicitFormat {
+		format, ok := extensionFormats[strings.ToLower(path.Ext(strings.TrimSuffix(settings.outFile, ".gpg")))]
+		if ok {
+			settings.fileFormat = format
+		} else if settings.fileFormat == "auto" {
+			abort("unable to tell the format from the --output name '" + settings.outFile + "', use --format")
+		}
+	}
+	if settings.fileFormat == "list" {
+		listFormats()
+		os.Exit(0)
+	}
+	if _, ok := outputFormats[settings.fileFormat]; !ok {
+		abort("unknown format '" + settings.fileFormat + "', use one of " + strings.Join(formatNames(), ", "))
+	}
 
-// exported ceph configuration metadata
-type cephMetaData struct {
-	DashboardURL  string   `json:"dashboard_url" yaml:"dashboard_url"`
-	Fsid          string   `json:"fsid" yaml:"fsid"`
-	Secret        string   `json:"secret" yaml:"secret"`
-	Mgr           string   `json:"mgr" yaml:"mgr"`
-	Mgrstandby    []string `json:"mgr_standby" yaml:"mgr_standby"`
-	Mons          []string `json:"mons" yaml:"mons"`
-	PrometheusURL string   `json:"prometheus_url" yaml:"prometheus_url"`
-	Rgws          []string `json:"rgws" yaml:"rgws"`
-	Version       string   `json:"version" yaml:"version"`
+	if settings.templateFile != "" && settings.templateName != "" {
+		abort("use either --template or --template-name, not both")
+	}
+	if settings.templateName != "" && !hasString(settings.templateName, templateNames()) {
+		abort("unknown template '" + settings.templateName + "', use one of " + strings.Join(templateNames(), ", "))
+	}
+
+	// with an S3 upload, a socket or a kubernetes apply, a local copy is
+	// only written when --output is given
+	if settings.s3Bucket != "" || settings.socket != "" || settings.k8sApply {
+		explicit := false
+		fs.Visit(func(f *flag.Flag) {
+			explicit = explicit || f.Name == "output"
+		})
+		if settings.s3Bucket != "" && settings.s3Key == "" {
+			settings.s3Key = withExtension(path.Base(settings.outFile), settings)
+		}
+		if !explicit {
+			settings.outFile = ""
+		}
+	}
+	if len(settings.gpgRecipients) > 0 {
+		if err := checkGPG(settings); err != nil {
+			abort(err.Error())
+		}
+	}
+	if settings.umask != "" {
+		mask, err := strconv.ParseUint(settings.umask, 8, 32)
+		if err != nil || mask > 0777 {
+			abort("--umask must be an octal mask, e.g. 077")
+		}
+		if err := setUmask(int(mask)); err != nil {
+			abort(err.Error())
+		}
+	}
 }
 
-func isDir(filePath string) bool {
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return false
+// keyrings of a named cluster are prefixed with the cluster name, so the
+// default pattern follows the cluster
+func clusterKeyringPattern(pattern string, cluster string) string {
+	if cluster != defaults["cluster"] && pattern == keyringFile {
+		return strings.Replace(keyringFile, "ceph.", cluster+".", 1)
 	}
-	return info.IsDir()
+	return pattern
 }
 
-func isFile(filePath string) bool {
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return false
+// read the whole content of an inherited file descriptor
+func readFd(fd int, name string) []byte {
+	file := os.NewFile(uintptr(fd), name+"-fd")
+	if file == nil {
+		abort(fmt.Sprintf("invalid %s file descriptor %d", name, fd))
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		abort(fmt.Sprintf("Unable to read the %s from file descriptor %d", name, fd))
 	}
-	return !info.IsDir()
+	return data
 }
 
-// look for string in a given slice
-func hasString(item string, iterable []string) bool {
-	for _, value := range iterable {
-		if item == value {
-			return true
-		}
+// build the runner used to query the cluster. Its commands are killed once
+// the context ends
+func newRunner(ctx context.Context, settings *runtimeSettings) CommandRunner {
+	keyring, _ := keyringFilePath(settings.confDir, settings)
+	var runner CommandRunner = execRunner{
+		cluster:      settings.cluster,
+		id:           settings.cephID,
+		cephArgs:     settings.cephArgs,
+		configData:   settings.configData,
+		keyringData:  settings.keyringData,
+		timeout:      settings.timeout,
+		ctx:          ctx,
+		cephadm:      settings.cephadm,
+		cephadmFsid:  settings.cephadmFsid,
+		cephadmImage: settings.cephadmImage,
+		confFile:     confFilePath(settings.confDir, settings),
+		keyringFile:  keyring,
 	}
-	return false
+	if settings.captureDir != "" {
+		runner = captureRunner{next: runner, dir: settings.captureDir}
+	}
+	return runner
 }
 
-// check if the environment is suitable for the export
-func ready(settings *runtimeSettings) (bool, error) {
+// errCollectTimeout is returned when the collection runs past --collect-timeout
+var errCollectTimeout = errors.New("the collection did not complete within the --collect-timeout")
 
-	keyring := fmt.Sprintf(keyringFile, settings.userName)
-	keyringStore := settings.confDir + "/keyring-store/keyring"
+// collect the metadata, bounded by --collect-timeout. The commands are
+// killed when the time is up, but a name lookup can't be, so the
+// collection is abandoned rather than waited on
+func collectWithin(settings *runtimeSettings, wrap func(CommandRunner) CommandRunner) (*cephMetaData, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if settings.collectTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), settings.collectTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
 
-	if !isDir(settings.confDir) {
-		return false, errors.New("Directory '" + settings.confDir + "' not found")
+	runner := newRunner(ctx, settings)
+	if wrap != nil {
+		runner = wrap(runner)
 	}
 
-	if !isFile(settings.confDir + "/ceph.conf") {
-		return false, errors.New("ceph configuration file missing from " + settings.confDir)
+	type result struct {
+		data *cephMetaData
+		err  error
 	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := collectMetadata(runner, settings)
+		done <- result{data, err}
+	}()
 
-	if !isFile(settings.confDir+"/"+keyring) && !isFile(keyringStore) {
-		return false, errors.New("missing keyring/keyring store")
+	select {
+	case r := <-done:
+		// a command killed at the deadline fails with its own error, which
+		// would hide the real cause
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errCollectTimeout
+		}
+		return r.data, r.err
+	case <-ctx.Done():
+		return nil, errCollectTimeout
 	}
+}
 
-	_, err := sendCommand("type ceph")
-	if err != nil {
-		return false, errors.New("ceph command is unavailable")
+// check the environment and load the key used in the export
+func prepareExport(settings *runtimeSettings) string {
+
+	fmt.Fprint(settings.progress, "\nChecking environment......")
+	ok, err := ready(settings)
+	if !ok {
+		fmt.Fprint(settings.progress, "FAILED\n")
+		abortError(err)
+	} else {
+		fmt.Fprint(settings.progress, "PASSED\n")
 	}
 
-	return true, nil
+	key, keySource, err := fetchKeyring(settings)
+	if err != nil {
+		abortError(fmt.Errorf("Unable to load a key for client.%s: %w", settings.cephID, err))
+	}
+	logInfo("using the key for client." + settings.cephID + " from " + keySource)
+	return key
 }
 
-// exit the program with an error message
-func abort(message string) {
-	fmt.Printf("Unable to continue: %s\n", message)
-	os.Exit(4)
+// versionPattern matches the version string ceph reports, for example
+// "ceph version 14.2.2-16.el8cp (<sha1>) nautilus (stable)"
+var versionPattern = regexp.MustCompile(`ceph version (\S+) \(\S+\) (\S+)`)
+
+// parse a ceph version string into the V.R.M version and the release name
+func parseVersion(versionStr string) (string, string, error) {
+	match := versionPattern.FindStringSubmatch(versionStr)
+	if match == nil {
+		return "", "", errors.New("unrecognised version string")
+	}
+	return strings.Split(match[1], "-")[0], match[2], nil
 }
 
-// send a command to the OS, and return the response to the caller
-func sendCommand(commandString string) (string, error) {
-	args := strings.Split(commandString, " ")
+// find the ceph version and release name. The json form of ceph version is
+// preferred, with the plain ceph --version output used on older clusters
+func collectVersion(runner CommandRunner) (string, string, error) {
 
-	cmd := exec.Command(args[0], args[1:]...)
-	out, err := cmd.Output()
+	var versionData struct {
+		Version string `json:"version"`
+	}
+	err := runJSON(runner, "ceph version -f json", &versionData)
+	if err == nil {
+		version, release, err := parseVersion(versionData.Version)
+		if err == nil {
+			return version, release, nil
+		}
+	}
+	logDebug("ceph version -f json is unavailable, falling back to ceph --version")
+
+	cephVersOutput, err := runner.Run("ceph --version")
 	if err != nil {
-		return "", errors.New("error running command")
+		return "", "", err
 	}
-	return string(out), nil
+	return parseVersion(cephVersOutput)
 }
 
-// find the keyring for the given user and return its key
-func fetchKeyring(userName string, confDir string) string {
+// query the cluster and build the metadata to export. The key is not part
+// of the collection, so the caller is responsible for adding it
+func collectMetadata(runner CommandRunner, settings *runtimeSettings) (*cephMetaData, error) {
 
-	var keyFile string
+	var exportData cephMetaData
 
-	keyFilePath := confDir + "/" + fmt.Sprintf(keyringFile, userName)
-	keyStore := confDir + "/keyring-store/keyring"
-	if isFile(keyFilePath) {
-		keyFile = keyFilePath
-	} else if isFile(keyStore) {
-		keyFile = keyStore
+	fmt.Fprint(settings.progress, "Querying ceph state.......")
+	cephStatusStr, err := runner.Run("ceph -s -f json")
+	if err != nil {
+		fmt.Fprint(settings.progress, "FAILED\n")
+		return nil, withHint(errors.New("Unable to gather status from ceph with 'ceph -s' command"), "cluster")
 	}
+	fmt.Fprint(settings.progress, "OK\n")
 
-	// what if keyFile is not set i.e. still empty?
-
-	conf, err := getConfig(keyFile)
+	bytes := []byte(cephStatusStr)
+	var cephStatus map[string]interface{}
+	err = json.Unmarshal(bytes, &cephStatus)
 	if err != nil {
-		return ""
+		return nil, errors.New("Unable to parse the json output from Ceph!")
 	}
-	keySection := conf.Section("client." + userName)
-	key, err := keySection.GetKey("key")
+
+	fmt.Fprint(settings.progress, "Checking ceph version.....")
+	exportData.Version, exportData.ReleaseName, err = collectVersion(runner)
 	if err != nil {
-		return ""
+		fmt.Fprint(settings.progress, "FAILED\n")
+		return nil, errors.New("failed trying to extract ceph version from the system")
 	}
 
-	return key.String()
-}
+	// cephadm based releases are 15 (octopus) onwards, so anything from
+	// nautilus on is accepted
+	major, _ := strconv.Atoi(strings.Split(exportData.Version, ".")[0])
+	if major < 14 {
+		fmt.Fprint(settings.progress, "FAILED\n")
+		return nil, errors.New("Export utility only supported on Nautilus or later clusters")
+	}
+	fmt.Fprint(settings.progress, "PASSED\n")
 
-// simplistic hstname check -if ir starts with a number, it's an IP address!
-func isIP(hostName string) bool {
-	char1 := string(hostName[0])
-	_, err := strconv.ParseInt(char1, 10, 8)
+	err = parseStatus(cephStatus, &exportData, settings)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	return true
-}
 
-// Read a ceph confg (ini) format
-func getConfig(confFileName string) (*ini.File, error) {
-	cfg, err := ini.Load(confFileName)
+	if !hasString("prometheus", exportData.EnabledModules) {
+		return nil, withHint(errors.New("Prometheus module must be enabled, prior to configuration export"), "prometheus")
+	}
+	fmt.Fprintln(settings.progress, "Active mgr module check...PASSED")
+
+	err = checkHealth(cephStatus, settings)
 	if err != nil {
-		return cfg, errors.New("Unable to load the config file")
+		return nil, err
 	}
-	return cfg, nil
-}
+	_, checks := parseHealth(cephStatus)
+	exportData.HealthChecks = filterHealthChecks(checks, settings.healthMinSeverity)
 
-// export to a file
-func writeFile(output []byte, settings *runtimeSettings) {
-	if strings.HasPrefix(settings.outFile, "~") {
-		usr, _ := user.Current()
-		settings.outFile = strings.Replace(settings.outFile, "~", usr.HomeDir, 1)
+	exportData.Fsid = cephStatus["fsid"].(string)
+	exportData.Fingerprint = fingerprint(exportData.Fsid)
+
+	// record when and where the export ran, for an audit trail
+	exportData.ExportedAt = settings.clock.Now().UTC().Format(time.RFC3339)
+	if !settings.noHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logWarning("unable to determine the local hostname")
+		}
+		exportData.ExportedFrom = hostname
 	}
-	fileName := settings.outFile + "." + settings.fileFormat
 
-	err := ioutil.WriteFile(fileName, output, 0644)
-	if err != nil {
-		fmt.Println(err)
-		abort("Failed to write the file ")
-	} else {
-		fmt.Println("\nMetadata written to " + fileName)
+	// the osdmap feeds several of the optional fields, so it's only
+	// fetched once
+	var osdMap *osdDump
+	if settings.includeOps || settings.includePools || settings.includeReleases {
+		osdMap = fetchOSDDump(runner)
+	}
+
+	if settings.includeOps {
+		collectOps(runner, &exportData, osdMap)
+	}
+
+	if settings.includePools {
+		collectAutoscale(runner, &exportData)
+	}
+
+	if settings.includePools || settings.includeOps {
+		collectRatios(osdMap, &exportData)
+	}
+
+	if settings.includeDashboardUser {
+		collectDashboardUser(runner, &exportData)
+	}
+
+	if settings.includeVersions {
+		collectDaemonVersions(runner, &exportData)
+	}
+
+	if settings.includeReleases {
+		collectReleases(runner, &exportData, osdMap)
+	}
+
+	if settings.verifyEndpoints {
+		err = verifyEndpoints(&exportData, settings)
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	if len(collectors) > 0 {
+		custom := runCollectors(runner)
+		if len(custom) > 0 {
+			exportData.Custom = custom
+		}
+	}
+
+	return &exportData, nil
 }
 
-// dump to json
-func toJSON(content *cephMetaData) []byte {
+// the layouts of the timestamps ceph has written over its releases, from
+// nautilus' "2019-09-16 20:44:37.123456" to the ISO 8601 forms with a zone
+var cephTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02T15:04:05.999999-0700",
+	"2006-01-02T15:04:05.999999Z07:00",
+	"2006-01-02 15:04:05.999999-0700",
+}
 
-	out, err := json.MarshalIndent(content, "", "    ")
-	if err != nil {
-		abort("Export to json failed")
+// convert a ceph timestamp to RFC3339 in UTC. Timestamps without a zone are
+// taken as UTC. Anything unrecognised is left out
+func cephTimestamp(value interface{}) string {
+	stamp, ok := value.(string)
+	if !ok || stamp == "" {
+		return ""
 	}
-	return out
+	for _, layout := range cephTimeLayouts {
+		t, err := time.Parse(layout, stamp)
+		if err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	logDebug("unrecognised timestamp " + stamp)
+	return ""
 }
 
-// dump to yaml
-func toYAML(content *cephMetaData) []byte {
+// a short, stable identifier for the cluster, which can be logged or used as
+// a key without giving away the fsid itself
+func fingerprint(fsid string) string {
+	sum := sha256.Sum256([]byte(fsid))
+	return hex.EncodeToString(sum[:])[:12]
+}
 
-	out := []byte("---\n")
-	yaml, err := yaml.Marshal(content)
-	if err != nil {
-		abort("Export to yaml failed")
+// the msgr2 endpoints from a monmap entry's public_addrs. A mon that only
+// listens on v1 has none
+func monV2Addrs(mon map[string]interface{}) []string {
+	var addrs []string
+	for _, addr := range monAddrvec(mon) {
+		if addr.Type == "v2" {
+			addrs = append(addrs, addr.Addr)
+		}
 	}
-	return append(out, yaml...)
+	return addrs
 }
 
-// write ceph facts to a file
-func exportMetadata(content *cephMetaData, settings *runtimeSettings) error {
+// every address in a monmap entry's public_addrs, in the order the mon
+// lists them. Older monmaps have no addrvec, leaving it empty
+func monAddrvec(mon map[string]interface{}) []MonAddress {
+	addrs := []MonAddress{}
+	publicAddrs, _ := mon["public_addrs"].(map[string]interface{})
+	addrvec, _ := publicAddrs["addrvec"].([]interface{})
+	for _, entry := range addrvec {
+		addr, _ := entry.(map[string]interface{})
+		addrType, _ := addr["type"].(string)
+		endpoint, ok := addr["addr"].(string)
+		if ok {
+			addrs = append(addrs, MonAddress{Type: addrType, Addr: endpoint})
+		}
+	}
+	return addrs
+}
 
-	// fmt.Println(*content)
-	// fmt.Println(*settings)
-	switch settings.fileFormat {
-	case "json":
-		out := toJSON(content)
-		writeFile(out, settings)
-		// fmt.Println(string(out))
-	case "yaml":
-		out := toYAML(content)
-		writeFile(out, settings)
+// check whether a service url points at the active mgr, by its name or
+// address. A url left behind by a failed over mgr points elsewhere. There's
+// no answer without a url
+func onActiveMgr(serviceURL string, activeName string, activeIP string) *bool {
+	u, err := url.Parse(serviceURL)
+	if serviceURL == "" || err != nil {
+		return nil
 	}
+	host := u.Hostname()
+	shortName := strings.Split(host, ".")[0]
 
-	return nil
+	active := host == activeIP || (activeName != "" && (host == activeName || shortName == strings.Split(activeName, ".")[0]))
+	return &active
 }
 
-func main() {
+// extract the overall health status and the active health checks, sorted
+// by their code
+func parseHealth(cephStatus map[string]interface{}) (string, []HealthCheck) {
 
-	var enabledModules []string
-	var exportData cephMetaData
+	checks := []HealthCheck{}
 
-	// Defaults for the command line args
-	outFile := flag.String("output", defaults["outFile"], "output file name")
-	confDir := flag.String("confdir", defaults["confDir"], "Ceph configuration directory")
-	fileFormat := flag.String("format", defaults["fileFormat"], "output file format")
-	userName := flag.String("user", defaults["userName"], "user keyring")
+	health, ok := cephStatus["health"].(map[string]interface{})
+	if !ok {
+		return "", checks
+	}
+	status, _ := health["status"].(string)
 
-	flag.Parse()
-	settings := runtimeSettings{
-		outFile:    *outFile,
-		confDir:    *confDir,
-		fileFormat: *fileFormat,
-		userName:   *userName,
+	checkMap, _ := health["checks"].(map[string]interface{})
+	for code, checkData := range checkMap {
+		check := HealthCheck{Code: code}
+		if detail, ok := checkData.(map[string]interface{}); ok {
+			check.Severity, _ = detail["severity"].(string)
+			if summary, ok := detail["summary"].(map[string]interface{}); ok {
+				check.Summary, _ = summary["message"].(string)
+			}
+		}
+		checks = append(checks, check)
 	}
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Code < checks[j].Code
+	})
 
-	fmt.Print("\nChecking environment......")
-	ok, err := ready(&settings)
-	if !ok {
-		fmt.Print("FAILED\n")
-		abort(err.Error())
-	} else {
-		fmt.Print("PASSED\n")
+	return status, checks
+}
+
+// healthSeverities ranks the --health-min-severity levels
+var healthSeverities = map[string]int{"warn": 1, "error": 2}
+
+// keep the health checks at or above a minimum severity. Without one, every
+// check is kept
+func filterHealthChecks(checks []HealthCheck, minSeverity string) []HealthCheck {
+	if minSeverity == "" {
+		return checks
+	}
+	filtered := []HealthCheck{}
+	for _, check := range checks {
+		level := healthSeverities["warn"]
+		if check.Severity == "HEALTH_ERR" {
+			level = healthSeverities["error"]
+		}
+		if level >= healthSeverities[minSeverity] {
+			filtered = append(filtered, check)
+		}
+	}
+	return filtered
+}
+
+// apply the --on-unhealthy policy, since an export taken in HEALTH_ERR may
+// not reflect the normal topology of the cluster
+func checkHealth(cephStatus map[string]interface{}, settings *runtimeSettings) error {
+
+	status, checks := parseHealth(cephStatus)
+	if status != "HEALTH_ERR" || settings.onUnhealthy == "proceed" {
+		return nil
 	}
 
-	key := fetchKeyring(settings.userName, settings.confDir)
-	if key == "" {
-		abort("Unable to load a key for the '" + *userName + "' user")
+	var reasons []string
+	for _, check := range checks {
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", check.Code, check.Summary))
+	}
+	message := "cluster is in HEALTH_ERR"
+	if len(reasons) > 0 {
+		message += ": " + strings.Join(reasons, ", ")
 	}
 
-	fmt.Print("Querying ceph state.......")
-	cephStatusStr, err := sendCommand("ceph -s -f json")
-	if err != nil {
-		fmt.Print("FAILED")
-		abort("Unable to gather status from ceph with 'ceph -s' command")
-	} else {
-		fmt.Print("OK\n")
+	if settings.onUnhealthy == "abort" {
+		return withHint(errors.New(message), "unhealthy")
 	}
+	logWarning("*** " + message + " ***")
+	return nil
+}
 
-	bytes := []byte(cephStatusStr)
-	var cephStatus map[string]interface{}
-	err = json.Unmarshal(bytes, &cephStatus)
-	if err != nil {
-		abort("Unable to parse the json output from Ceph!")
+// add the number of placement groups and how many are in each state. The
+// states are a map, which the encoders write in sorted key order
+func parsePGMap(pgMap interface{}, exportData *cephMetaData) {
+
+	pgs, _ := pgMap.(map[string]interface{})
+	if count, ok := pgs["num_pgs"].(float64); ok {
+		exportData.PGCount = int(count)
 	}
 
-	fmt.Print("Checking ceph version.....")
-	cephVersOutput, err := sendCommand("ceph --version")
-	if err != nil {
-		fmt.Print("FAILED\n")
-		abort("failed trying to extract ceph version from the system")
+	byState, _ := pgs["pgs_by_state"].([]interface{})
+	for _, stateData := range byState {
+		state, _ := stateData.(map[string]interface{})
+		name, ok := state["state_name"].(string)
+		if !ok {
+			continue
+		}
+		count, _ := state["count"].(float64)
+		exportData.PGStates[name] += int(count)
 	}
+}
 
-	// the first 13 chars are 'ceph version ', so let's skip those!
-	exportData.Version = strings.Split(cephVersOutput[13:], "-")[0]
-	if !strings.HasPrefix(exportData.Version, "14") {
-		abort("Export utility only supported on Nautilus clusters")
-	} else {
-		fmt.Print("PASSED\n")
+// return the ports from an rgw frontend config e.g. "beast port=8080"
+func frontendPorts(frontEnd string) []string {
+	var ports []string
+	for _, item := range strings.Split(frontEnd, " ") {
+		parms := strings.SplitN(item, "=", 2)
+		if len(parms) == 2 && strings.HasSuffix(parms[0], "port") {
+			ports = append(ports, parms[1])
+		}
+	}
+	return ports
+}
+
+// extract the rgw daemons, ports and endpoints from the servicemap. A daemon
+// may have several frontends (frontend_config#0, #1...), and any missing or
+// malformed part of the map is skipped. Every daemon is listed, even when
+// none of its endpoints can be worked out
+func parseServiceMap(serviceMap interface{}, exportData *cephMetaData, settings *runtimeSettings) {
+
+	svcMap, _ := serviceMap.(map[string]interface{})
+	svcs, _ := svcMap["services"].(map[string]interface{})
+	rgw, _ := svcs["rgw"].(map[string]interface{})
+	rgwDaemons, _ := rgw["daemons"].(map[string]interface{})
+
+	for rgwKey, rgwData := range rgwDaemons {
+		if rgwKey == "summary" {
+			continue
+		}
+		exportData.RgwDaemons = append(exportData.RgwDaemons, rgwKey)
+
+		daemon, _ := rgwData.(map[string]interface{})
+		rgwMeta, ok := daemon["metadata"].(map[string]interface{})
+		if !ok {
+			logDebug("rgw " + rgwKey + " has no metadata")
+			continue
+		}
+		// the daemon name is the fallback, since it normally encodes the host
+		hostName, ok := rgwMeta["hostname"].(string)
+		if !ok || hostName == "" {
+			hostName = rgwKey
+		}
+		hostName = trimDomain(hostName, settings)
+
+		for metaKey, metaValue := range rgwMeta {
+			if !strings.HasPrefix(metaKey, "frontend_config#") {
+				continue
+			}
+			frontEnd, ok := metaValue.(string)
+			if !ok {
+				logDebug("rgw " + rgwKey + " has an invalid " + metaKey)
+				continue
+			}
+			for _, port := range frontendPorts(frontEnd) {
+				exportData.Rgws = append(exportData.Rgws, port)
+				exportData.RgwEndpoints = append(exportData.RgwEndpoints, net.JoinHostPort(hostName, port))
+			}
+		}
 	}
+}
+
+// extract the export fields from the ceph -s output
+func parseStatus(cephStatus map[string]interface{}, exportData *cephMetaData, settings *runtimeSettings) error {
+
+	var err error
+	var activeName string
+
+	// pg_states is always exported, even when the status has no pgmap
+	exportData.PGStates = make(map[string]int)
 
 	for idx, k := range cephStatus {
 
@@ -301,79 +2689,250 @@ func main() {
 				switch midx {
 				case "mons":
 					// fmt.Println("processing mons")
-					for _, monData := range mval.([]interface{}) {
-						monIP := monData.(map[string]interface{})["addr"]
-						exportData.Mons = append(exportData.Mons, monIP.(string))
+					mons, _ := mval.([]interface{})
+					for _, monData := range mons {
+						mon, _ := monData.(map[string]interface{})
+						monIP, _ := mon["addr"].(string)
+						err = validateMonAddr(mon["name"], monIP, settings)
+						if err != nil {
+							return err
+						}
+						exportData.Mons = append(exportData.Mons, monIP)
+						exportData.MonV2 = append(exportData.MonV2, monV2Addrs(mon)...)
+						monName, _ := mon["name"].(string)
+						exportData.MonPublicAddrs = append(exportData.MonPublicAddrs, MonPublicAddrs{
+							Name:  monName,
+							Addrs: monAddrvec(mon),
+						})
 					}
+				case "epoch":
+					if epoch, ok := mval.(float64); ok {
+						exportData.MonmapEpoch = int(epoch)
+					}
+				case "created":
+					exportData.MonmapCreated = cephTimestamp(mval)
+				case "modified":
+					exportData.MonmapModified = cephTimestamp(mval)
 				}
 			}
+		case "election_epoch":
+			if epoch, ok := k.(float64); ok {
+				exportData.ElectionEpoch = int(epoch)
+			}
 		case "mgrmap":
 			// fmt.Println("Processing mgrmap")
 			for mgrKey, mgrVal := range k.(map[string]interface{}) {
 
 				switch mgrKey {
+				case "active_name":
+					activeName, _ = mgrVal.(string)
 				case "active_addr":
-					exportData.Mgr = strings.Split(mgrVal.(string), ":")[0]
+					activeAddr, _ := mgrVal.(string)
+					host, port, err := splitCephAddr(activeAddr)
+					if err != nil {
+						err = reportInvalid(fmt.Sprintf("active mgr address '%s' is invalid (%s)", activeAddr, err), settings)
+						if err != nil {
+							return err
+						}
+						exportData.Mgr = activeAddr
+						continue
+					}
+					exportData.Mgr = host
+					exportData.MgrAddr = net.JoinHostPort(host, port)
+					exportData.MgrPort, _ = strconv.Atoi(port)
 				case "standbys":
-					for _, stdbyData := range mgrVal.([]interface{}) {
-						s := stdbyData.(map[string]interface{})
-						mgrName := s["name"].(string)
-						if !isIP(mgrName) {
-							ip, err := net.LookupHost(mgrName)
-							if err == nil {
-								mgrName = ip[0]
+					standbys, ok := mgrVal.([]interface{})
+					if !ok {
+						logDebug("mgrmap has no standbys list")
+						continue
+					}
+					for _, stdbyData := range standbys {
+						s, _ := stdbyData.(map[string]interface{})
+						name, ok := s["name"].(string)
+						if !ok || name == "" {
+							// a gid alone can't be turned into an address,
+							// so the standby is left out
+							if gid, ok := s["gid"].(float64); ok {
+								logDebug(fmt.Sprintf("skipping the mgr standby with gid %.0f, it has no name", gid))
+							} else {
+								logDebug("skipping a mgr standby with no name or gid")
 							}
+							continue
 						}
+						mgrName := resolveName(name, settings)
 						exportData.Mgrstandby = append(exportData.Mgrstandby, mgrName)
 					}
 				case "modules":
-					for _, mod := range mgrVal.([]interface{}) {
-						enabledModules = append(enabledModules, mod.(string))
+					modules, ok := mgrVal.([]interface{})
+					if !ok {
+						logDebug("mgrmap has no modules list")
+						continue
+					}
+					for _, mod := range modules {
+						if modName, ok := mod.(string); ok {
+							exportData.EnabledModules = append(exportData.EnabledModules, modName)
+						}
 					}
 				case "services":
-					for svcName, svcURL := range mgrVal.(map[string]interface{}) {
+					// services is absent or null when no module publishes a url
+					services, ok := mgrVal.(map[string]interface{})
+					if !ok {
+						logDebug("mgrmap has no services, so no urls to export")
+						continue
+					}
+					for svcName, svcURL := range services {
+						urlStr, ok := svcURL.(string)
+						if !ok {
+							logDebug("ignoring non-string url for the " + svcName + " service")
+							continue
+						}
 						switch svcName {
 						case "dashboard":
-							exportData.DashboardURL = svcURL.(string)
+							exportData.DashboardURL, err = cleanURL(svcName, urlStr, settings)
+							exportData.DashboardTLS = strings.HasPrefix(exportData.DashboardURL, "https://")
 						case "prometheus":
-							exportData.PrometheusURL = svcURL.(string)
+							exportData.PrometheusURL, err = cleanURL(svcName, urlStr, settings)
+						}
+						if err != nil {
+							return err
 						}
 					}
 				}
 			}
+		case "pgmap":
+			parsePGMap(k, exportData)
 		case "servicemap":
-			svcMap := k.(map[string]interface{})
-			svcs := svcMap["services"].(map[string]interface{})
+			parseServiceMap(k, exportData, settings)
+		}
 
-			if rgw, ok := svcs["rgw"]; ok {
-				rgwDaemons := rgw.(map[string]interface{})["daemons"]
-				for rgwKey, rgwData := range rgwDaemons.(map[string]interface{}) {
-					if rgwKey == "summary" {
-						continue
-					}
-					rgwMeta := rgwData.(map[string]interface{})["metadata"]
-					frontEnd := rgwMeta.(map[string]interface{})["frontend_config#0"].(string)
-					fendSettings := strings.Split(frontEnd, " ")
-					for _, item := range fendSettings {
-						parms := strings.Split(item, "=")
-						if strings.HasSuffix(parms[0], "port") {
-							exportData.Rgws = append(exportData.Rgws, parms[1])
-						}
-					}
-				}
-			}
+	}
+
+	// the urls are compared once the whole mgrmap is known
+	exportData.DashboardOnActiveMgr = onActiveMgr(exportData.DashboardURL, activeName, exportData.Mgr)
+	exportData.PrometheusOnActiveMgr = onActiveMgr(exportData.PrometheusURL, activeName, exportData.Mgr)
+
+	// map iteration order is random, so sort the lists to give the same
+	// output for the same cluster state
+	exportData.Mons = uniqueStrings(exportData.Mons)
+	exportData.MonV2 = uniqueStrings(exportData.MonV2)
+	if exportData.MonPublicAddrs == nil {
+		exportData.MonPublicAddrs = []MonPublicAddrs{}
+	}
+	sort.Slice(exportData.MonPublicAddrs, func(i, j int) bool {
+		return exportData.MonPublicAddrs[i].Name < exportData.MonPublicAddrs[j].Name
+	})
+	exportData.Mgrstandby = uniqueStrings(exportData.Mgrstandby)
+	exportData.Rgws = uniqueStrings(exportData.Rgws)
+	exportData.RgwEndpoints = uniqueStrings(exportData.RgwEndpoints)
+	exportData.RgwDaemons = uniqueStrings(exportData.RgwDaemons)
+	exportData.EnabledModules = uniqueStrings(exportData.EnabledModules)
+
+	return nil
+}
 
+// add the flags that select another mode of the export command
+func addExportFlags(fs *flag.FlagSet, selfTestMode *bool, listUsersMode *bool, printConfigMode *bool) {
+	fs.BoolVar(selfTestMode, "self-test", false, "check the parsing against embedded fixtures")
+	fs.BoolVar(listUsersMode, "list-users", false, "list the client identities in the local keyrings, without exporting")
+	fs.BoolVar(printConfigMode, "print-config", false, "print the settings the export would use, without exporting")
+}
+
+// the default command, which collects the metadata and writes the export
+func export(args []string, settings *runtimeSettings) {
+
+	var selfTestMode, listUsersMode, printConfigMode bool
+	addFlags(flag.CommandLine, settings)
+	addOutputFlags(flag.CommandLine, settings)
+	addExportFlags(flag.CommandLine, &selfTestMode, &listUsersMode, &printConfigMode)
+	flag.Usage = func() {
+		usage(flag.CommandLine)()
+		printCommands(flag.CommandLine.Output())
+	}
+	flag.CommandLine.Parse(args)
+
+	if selfTestMode {
+		selfTest()
+		return
+	}
+	prepareSettings(flag.CommandLine, settings)
+	prepareOutput(flag.CommandLine, settings)
+
+	if listUsersMode {
+		listUsers(settings)
+		return
+	}
+	if printConfigMode {
+		printConfig(flag.CommandLine, settings)
+		return
+	}
+
+	var audit auditLog
+	if settings.syslog {
+		var err error
+		audit, err = openAuditLog(settings.syslogFacility, settings.syslogTag)
+		if err != nil {
+			abort("Unable to use syslog (" + err.Error() + ")")
 		}
+		abortHook = func(message string) {
+			audit.Err("export failed: " + message)
+		}
+	}
 
+	if multiCluster(settings) {
+		exportClusters(settings, audit)
+		return
 	}
 
-	if !hasString("prometheus", enabledModules) {
-		abort("Prometheus module must be enabled, prior to configuration export")
+	key := prepareExport(settings)
+
+	start := time.Now()
+	exportData, err := collectWithin(settings, nil)
+	if err != nil {
+		abortError(err)
 	}
-	fmt.Println("Active mgr module check...PASSED")
+	logDebug(fmt.Sprintf("collection took %s", time.Since(start).Round(time.Millisecond)))
+	applyLocalConfig(exportData, settings)
 
+	checkWarnings(settings)
 	exportData.Secret = key
-	exportData.Fsid = cephStatus["fsid"].(string)
+	err = checkRequiredFields(exportData, settings)
+	if err != nil {
+		abort(err.Error())
+	}
+
+	err = exportMetadata(exportData, settings)
+	if err != nil {
+		abortError(err)
+	}
+	if audit != nil {
+		auditExport(audit, exportData, settings)
+	}
+}
+
+// stop before anything is written when there were warnings and
+// --fail-on-warn is set
+func checkWarnings(settings *runtimeSettings) {
+	if settings.failOnWarn && len(warnings) > 0 {
+		message := fmt.Sprintf("%d warning(s) with --fail-on-warn", len(warnings))
+		if abortHook != nil {
+			abortHook(message)
+		}
+		if errorFormat == "json" {
+			exitWithError(exportError{Error: message, Code: 5, Warnings: warnings})
+		}
+		fmt.Fprintf(os.Stderr, "\nExport failed, with %d warning(s):\n", len(warnings))
+		for _, warning := range warnings {
+			fmt.Fprintln(os.Stderr, "  "+warning)
+		}
+		os.Exit(5)
+	}
+}
+
+func main() {
+
+	// stdout is kept for the export itself, so progress goes to stderr
+	settings := runtimeSettings{progress: os.Stderr, clock: systemClock{}}
 
-	exportMetadata(&exportData, &settings)
+	name, args := splitCommand(os.Args[1:])
+	commands[name].run(args, &settings)
 }
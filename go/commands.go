@@ -0,0 +1,145 @@
+package main
+
+//
+// subcommands - each mode of the tool is a command, with export as the
+// default so a bare invocation behaves as it always has
+//
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// command is a mode of the tool, run with the arguments after its name
+type command struct {
+	description string
+	// shared commands take the connection and collection flags, so flags
+	// given before the command name (e.g. --confdir) are handed on to them.
+	// Only export takes the output flags
+	shared bool
+	run    func(args []string, settings *runtimeSettings)
+	// flags adds the command's own flags, for shell completion
+	flags func(fs *flag.FlagSet)
+}
+
+// commands holds every command, by name. It's filled in by init, since the
+// commands' usage refers back to it
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"export": {
+			description: "collect the cluster metadata and write the export (the default)",
+			shared:      true,
+			run:         export,
+			flags: func(fs *flag.FlagSet) {
+				var selfTestMode, listUsersMode, printConfigMode bool
+				addOutputFlags(fs, &runtimeSettings{})
+				addExportFlags(fs, &selfTestMode, &listUsersMode, &printConfigMode)
+			},
+		},
+		"serve": {
+			description: "serve the metadata over http",
+			shared:      true,
+			run:         serve,
+			flags: func(fs *flag.FlagSet) {
+				addServeFlags(fs, &serveOptions{})
+			},
+		},
+		"doctor": {
+			description: "check the environment is ready for an export",
+			shared:      true,
+			run:         doctor,
+		},
+		"validate": {
+			description: "check an existing export file can be used",
+			run: func(args []string, settings *runtimeSettings) {
+				validate(args)
+			},
+			flags: func(fs *flag.FlagSet) {
+				var strictJSON bool
+				addValidateFlags(fs, &strictJSON)
+			},
+		},
+		"completion": {
+			description: "write a bash, zsh or fish completion script to stdout",
+			run: func(args []string, settings *runtimeSettings) {
+				completion(args)
+			},
+		},
+	}
+}
+
+// the names of the commands, sorted
+func commandNames() []string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the flags a command takes, without the hidden ones
+func commandFlags(name string) []*flag.Flag {
+	cmd := commands[name]
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	if cmd.shared {
+		addFlags(fs, &runtimeSettings{})
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		if !hasString(f.Name, hiddenFlags) {
+			flags = append(flags, f)
+		}
+	})
+	return flags
+}
+
+// list the commands, for the usage output
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "\nCommands (export is used when none is given):\n")
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].description)
+	}
+}
+
+// find the command to run and its arguments. Flags may come before the
+// command name, and are handed on to a shared command. Without a command
+// name everything is for export
+func splitCommand(args []string) (string, []string) {
+
+	// parse a copy of the flags, just to find where they end. The output
+	// flags are included, and a command that doesn't take them rejects them
+	// when it parses its own
+	var scratch runtimeSettings
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	addFlags(fs, &scratch)
+	addOutputFlags(fs, &scratch)
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		return "export", args
+	}
+
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", name)
+		printCommands(os.Stderr)
+		os.Exit(2)
+	}
+
+	global := args[:len(args)-fs.NArg()]
+	if len(global) > 0 && !cmd.shared {
+		abort("the " + name + " command doesn't take the export flags")
+	}
+	return name, append(append([]string{}, global...), fs.Args()[1:]...)
+}
@@ -0,0 +1,137 @@
+package main
+
+//
+// shell completion - scripts generated from the command table and each
+// command's flags, so they can't drift from the real interface
+//
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the flag names of a command, as --name words
+func flagWords(name string) []string {
+	var words []string
+	for _, f := range commandFlags(name) {
+		words = append(words, "--"+f.Name)
+	}
+	return words
+}
+
+// the words completed after a command: its flags, and for completion the
+// shells
+func commandWords(name string) []string {
+	words := flagWords(name)
+	if name == "completion" {
+		words = append(words, completionShells...)
+	}
+	return words
+}
+
+// completionShells are the shells a script can be written for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// the words completed before a command is given: the command names, and the
+// flags of the default export command
+func topLevelWords() []string {
+	return append(commandNames(), flagWords("export")...)
+}
+
+func bashCompletion(program string) string {
+	function := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(program)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n", program)
+	fmt.Fprintf(&b, "%s() {\n", function)
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" cmd=\"\" opts files word\n")
+	b.WriteString("    for word in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do\n")
+	fmt.Fprintf(&b, "        case \"$word\" in\n            %s) cmd=\"$word\"; break ;;\n        esac\n", strings.Join(commandNames(), "|"))
+	b.WriteString("    done\n")
+	b.WriteString("    case \"$cmd\" in\n")
+	for _, name := range commandNames() {
+		fmt.Fprintf(&b, "        %s) opts=\"%s\" ;;\n", name, strings.Join(commandWords(name), " "))
+	}
+	fmt.Fprintf(&b, "        *) opts=\"%s\" ;;\n", strings.Join(topLevelWords(), " "))
+	b.WriteString("    esac\n")
+	b.WriteString("    # validate takes the export file to check\n")
+	b.WriteString("    [ \"$cmd\" = validate ] && files=$(compgen -f -- \"$cur\")\n")
+	b.WriteString("    COMPREPLY=( $(compgen -W \"$opts\" -- \"$cur\") $files )\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -F %s %s\n", function, program)
+	return b.String()
+}
+
+func zshCompletion(program string) string {
+	function := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(program)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n", program)
+	fmt.Fprintf(&b, "%s() {\n", function)
+	b.WriteString("    local -a opts\n")
+	fmt.Fprintf(&b, "    local cmd=${words[(r)(%s)]}\n", strings.Join(commandNames(), "|"))
+	b.WriteString("    case $cmd in\n")
+	for _, name := range commandNames() {
+		fmt.Fprintf(&b, "        %s) opts=(%s) ;;\n", name, strings.Join(commandWords(name), " "))
+	}
+	fmt.Fprintf(&b, "        *) opts=(%s) ;;\n", strings.Join(topLevelWords(), " "))
+	b.WriteString("    esac\n")
+	b.WriteString("    compadd -- $opts\n")
+	b.WriteString("    [[ $cmd == validate ]] && _files\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "compdef %s %s\n", function, program)
+	return b.String()
+}
+
+// quote a string for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func fishCompletion(program string) string {
+	names := strings.Join(commandNames(), " ")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", program)
+	fmt.Fprintf(&b, "complete -c %s -f\n", program)
+	for _, name := range commandNames() {
+		fmt.Fprintf(&b, "complete -c %s -n '__fish_use_subcommand' -a %s -d %s\n", program, name, fishQuote(commands[name].description))
+	}
+	for _, f := range commandFlags("export") {
+		fmt.Fprintf(&b, "complete -c %s -n 'not __fish_seen_subcommand_from %s' -l %s -d %s\n", program, names, f.Name, fishQuote(f.Usage))
+	}
+	for _, name := range commandNames() {
+		for _, f := range commandFlags(name) {
+			fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from %s' -l %s -d %s\n", program, name, f.Name, fishQuote(f.Usage))
+		}
+	}
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from completion' -a '%s'\n", program, strings.Join(completionShells, " "))
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from validate' -F\n", program)
+	return b.String()
+}
+
+// write the completion script for a shell to stdout
+func completion(args []string) {
+
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s completion bash|zsh|fish\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	program := filepath.Base(os.Args[0])
+	switch fs.Arg(0) {
+	case "bash":
+		fmt.Print(bashCompletion(program))
+	case "zsh":
+		fmt.Print(zshCompletion(program))
+	case "fish":
+		fmt.Print(fishCompletion(program))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+//
+// doctor - a preflight that explains each environment check in detail,
+// without exporting anything
+//
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// remediation hints for the problems doctor can find, which are also shown
+// when an export fails for the same reason
+var hints = map[string]string{
+	"confdir":    "check --confdir points at the ceph configuration directory",
+	"config":     "copy the cluster's config file from a mon node, or use --cluster for a named cluster",
+	"keyring":    "copy the client keyring from a mon node, or use --user/--keyring-pattern to select another",
+	"key":        "check the keyring has a [client.<user>] section with a key entry",
+	"binary":     "install the ceph-common package",
+	"cluster":    "check the mons are reachable and the key is authorised (try 'ceph -s')",
+	"prometheus": "enable the module with 'ceph mgr module enable prometheus'",
+	"unhealthy":  "resolve the health errors, or use --on-unhealthy warn to export anyway",
+}
+
+// doctorCheck is the outcome of a single diagnostic check
+type doctorCheck struct {
+	name    string
+	passed  bool
+	blocker bool
+	detail  string
+	hint    string
+}
+
+// check whether stdout is attached to a terminal, for colored output
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// print a check result, green for a pass and red (or yellow for a non
+// blocker) for a failure
+func (c doctorCheck) print(color bool) {
+	status, code := "PASS", "32"
+	if !c.passed {
+		status, code = "WARN", "33"
+		if c.blocker {
+			status, code = "FAIL", "31"
+		}
+	}
+	if color {
+		status = "\033[" + code + "m" + status + "\033[0m"
+	}
+
+	fmt.Printf("[%s] %-24s %s\n", status, c.name, c.detail)
+	if !c.passed && c.hint != "" {
+		fmt.Printf("       %-24s hint: %s\n", "", c.hint)
+	}
+}
+
+// pick the description matching a check's outcome
+func describe(passed bool, pass string, fail string) string {
+	if passed {
+		return pass
+	}
+	return fail
+}
+
+// describe a checked path, or why it couldn't be checked
+func pathDetail(path string, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return path
+}
+
+// run the environment checks, in the order an export depends on them
+func runDoctorChecks(settings *runtimeSettings) []doctorCheck {
+
+	var checks []doctorCheck
+
+	// a missing directory only stops the export when something is read
+	// from it
+	confDirOK, err := isDir(settings.confDir)
+	checks = append(checks, doctorCheck{
+		name:    "config directory",
+		passed:  confDirOK,
+		blocker: needConfDir(settings),
+		detail:  pathDetail(settings.confDir, err),
+		hint:    hints["confdir"],
+	})
+
+	confFile := confFilePath(settings.confDir, settings)
+	confFileOK, err := isFile(confFile)
+	checks = append(checks, doctorCheck{
+		name:    "cluster config",
+		passed:  settings.configData != nil || confFileOK,
+		blocker: true,
+		detail:  pathDetail(confFile, err),
+		hint:    hints["config"],
+	})
+
+	var found []string
+	candidates := keyringCandidates(settings.confDir, settings)
+	for _, path := range candidates {
+		if ok, _ := isFile(path); ok {
+			found = append(found, path)
+		}
+	}
+	if settings.keyringData != nil {
+		found = append(found, fmt.Sprintf("fd %d", settings.keyringFd))
+	}
+	keyringDetail := "none of " + strings.Join(candidates, ", ")
+	if len(found) > 0 {
+		keyringDetail = strings.Join(found, ", ")
+	}
+	checks = append(checks, doctorCheck{
+		name:    "keyring files",
+		passed:  len(found) > 0,
+		blocker: true,
+		detail:  keyringDetail,
+		hint:    hints["keyring"],
+	})
+
+	keyDetail := "not found"
+	keyOK := false
+	if len(found) > 0 {
+		_, keySource, err := fetchKeyring(settings)
+		keyOK = err == nil
+		keyDetail = describe(keyOK, "loaded from "+keySource, fmt.Sprint(err))
+	}
+	checks = append(checks, doctorCheck{
+		name:    "key for client." + settings.cephID,
+		passed:  keyOK,
+		blocker: true,
+		detail:  keyDetail,
+		hint:    hints["key"],
+	})
+
+	command := "ceph"
+	if settings.cephadm {
+		command = "cephadm"
+	}
+	cephPath, err := exec.LookPath(command)
+	binaryCheck := doctorCheck{
+		name:    command + " command",
+		passed:  err == nil,
+		blocker: true,
+		detail:  "not found on PATH",
+		hint:    hints["binary"],
+	}
+	if err != nil {
+		return append(checks, binaryCheck)
+	}
+
+	runner := newRunner(context.Background(), settings)
+	binaryCheck.detail = cephPath
+	version, err := runner.Run("ceph --version")
+	if err == nil {
+		binaryCheck.detail += " (" + strings.TrimSpace(version) + ")"
+	}
+	checks = append(checks, binaryCheck)
+
+	var status struct {
+		Mgrmap struct {
+			Modules []string `json:"modules"`
+		} `json:"mgrmap"`
+	}
+	err = runJSON(runner, "ceph -s -f json", &status)
+	checks = append(checks, doctorCheck{
+		name:    "cluster access",
+		passed:  err == nil,
+		blocker: true,
+		detail:  describe(err == nil, "ceph -s succeeded", "ceph -s failed"),
+		hint:    hints["cluster"],
+	})
+	if err != nil {
+		return checks
+	}
+
+	prometheus := hasString("prometheus", status.Mgrmap.Modules)
+	checks = append(checks, doctorCheck{
+		name:    "prometheus module",
+		passed:  prometheus,
+		blocker: true,
+		detail:  describe(prometheus, "enabled", "disabled"),
+		hint:    hints["prometheus"],
+	})
+
+	return checks
+}
+
+// diagnose the environment, exiting non-zero when an export would fail
+func doctor(args []string, settings *runtimeSettings) {
+
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	addFlags(fs, settings)
+	fs.Parse(args)
+	prepareSettings(fs, settings)
+
+	color := stdoutIsTerminal()
+	blocked := false
+	for _, check := range runDoctorChecks(settings) {
+		check.print(color)
+		if !check.passed && check.blocker {
+			blocked = true
+		}
+	}
+
+	if blocked {
+		fmt.Println("\nThe environment is not ready for an export")
+		os.Exit(1)
+	}
+	fmt.Println("\nThe environment is ready for an export")
+}
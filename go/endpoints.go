@@ -0,0 +1,77 @@
+package main
+
+//
+// endpoint checks - confirm the exported service urls answer, since a url in
+// the mgrmap can outlive the service behind it
+//
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// endpointAttempts is how many times an endpoint is tried before it's
+// reported as unreachable, riding out a mgr that's just failing over
+const endpointAttempts = 3
+
+// check a url answers a GET. Any http response counts, since the dashboard
+// answers with a redirect or an auth failure, and its certificate is often
+// self signed, so it isn't verified
+func endpointReachable(endpoint string, settings *runtimeSettings) bool {
+	timeout := settings.timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	client := http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for attempt := 1; attempt <= endpointAttempts; attempt++ {
+		resp, err := client.Get(endpoint)
+		if err == nil {
+			resp.Body.Close()
+			return true
+		}
+		logDebug(fmt.Sprintf("attempt %d to reach %s failed (%s)", attempt, endpoint, err))
+		if attempt < endpointAttempts {
+			time.Sleep(time.Second)
+		}
+	}
+	return false
+}
+
+// record whether the dashboard and prometheus urls answer. An unreachable
+// url is a warning, or an error under --strict
+func verifyEndpoints(exportData *cephMetaData, settings *runtimeSettings) error {
+	endpoints := []struct {
+		name      string
+		url       string
+		reachable **bool
+	}{
+		{"dashboard", exportData.DashboardURL, &exportData.DashboardReachable},
+		{"prometheus", exportData.PrometheusURL, &exportData.PrometheusReachable},
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.url == "" {
+			continue
+		}
+		reachable := endpointReachable(endpoint.url, settings)
+		*endpoint.reachable = &reachable
+		if !reachable {
+			err := reportInvalid("the "+endpoint.name+" url "+endpoint.url+" is unreachable", settings)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+//
+// gpg encryption - encrypt the whole export for one or more recipients,
+// using the system gpg and the keys in the user's keyring
+//
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// check gpg is installed and holds a public key for every recipient, so a
+// missing key is found before the cluster is queried
+func checkGPG(settings *runtimeSettings) error {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		return errors.New("--gpg-recipient needs gpg, which is not on the PATH")
+	}
+	for _, recipient := range settings.gpgRecipients {
+		_, err := runCommand(context.Background(), []string{"gpg", "--batch", "--list-keys", recipient})
+		if err != nil {
+			return errors.New("gpg has no public key for the recipient " + recipient)
+		}
+	}
+	return nil
+}
+
+// encrypt the export for the --gpg-recipient keys. The export is handed to
+// gpg through a pipe, so the plain text never reaches the disk
+func encryptGPG(output []byte, settings *runtimeSettings) ([]byte, error) {
+	args := []string{"gpg", "--batch", "--yes", "--trust-model", "always", "--encrypt"}
+	for _, recipient := range settings.gpgRecipients {
+		args = append(args, "--recipient", recipient)
+	}
+	args = append(args, "--output", "-", "/dev/fd/3")
+
+	ctx := context.Background()
+	if settings.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.timeout)
+		defer cancel()
+	}
+	encrypted, err := runCommand(ctx, args, output)
+	if err != nil {
+		return nil, errors.New("gpg was unable to encrypt the export (" + err.Error() + ")")
+	}
+	return []byte(encrypted), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+//
+// grafana output - a datasource for the grafana http api, so an export can
+// provision a dashboard host directly
+//
+
+// grafanaDatasource holds the fields the grafana datasource api requires
+type grafanaDatasource struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Access    string `json:"access"`
+	URL       string `json:"url"`
+	IsDefault bool   `json:"isDefault"`
+}
+
+// render the prometheus url as a datasource, named by the cluster's
+// fingerprint so several clusters can be provisioned side by side
+func toGrafanaDatasource(content *cephMetaData, settings *runtimeSettings) []byte {
+	content = redactMetadata(content, settings)
+	datasource := grafanaDatasource{
+		Name:   "ceph-" + content.Fingerprint,
+		Type:   "prometheus",
+		Access: "proxy",
+		URL:    content.PrometheusURL,
+	}
+	return toJSON(datasource, settings.indent)
+}
@@ -0,0 +1,129 @@
+package main
+
+//
+// kubernetes output - the metadata as manifests, ready to be applied to a
+// cluster hosting ceph clients
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// k8sMeta is the metadata section common to the kubernetes objects
+type k8sMeta struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type k8sConfigMap struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMeta           `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+}
+
+// k8sSecret holds the key in stringData, for kubernetes to encode, or in
+// data when --secret-format base64 has already encoded it
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMeta           `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+}
+
+// split the export into a ConfigMap of the non-sensitive fields and a Secret
+// holding only the key, so clients can be given the one without the other.
+// ConfigMap values must be strings, so anything else is held as json
+func toK8sSplit(content *cephMetaData, settings *runtimeSettings) []byte {
+
+	// the objects are the top level, so any --wrap key is ignored
+	var fields map[string]interface{}
+	view := fieldView(redactMetadata(content, settings), settings)
+	err := json.Unmarshal(toJSON(view, ""), &fields)
+	if err != nil {
+		abort("Export to k8s-split failed")
+	}
+
+	// the secret is looked up by field name, so it respects --exclude and
+	// --no-secret as any other field does
+	secret, _ := fields["secret"].(string)
+	delete(fields, "secret")
+
+	meta := k8sMeta{Name: settings.k8sName, Namespace: settings.k8sNamespace}
+	configMap := k8sConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   meta,
+		Data:       make(map[string]string),
+	}
+	for name, value := range fields {
+		if str, ok := value.(string); ok {
+			configMap.Data[name] = str
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		configMap.Data[name] = string(encoded)
+	}
+
+	docs := []interface{}{configMap}
+	if secret != "" {
+		k8sKey := k8sSecret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata:   meta,
+			Type:       "Opaque",
+		}
+		if settings.secretFormat == "base64" {
+			k8sKey.Data = map[string]string{"key": secret}
+		} else {
+			k8sKey.StringData = map[string]string{"key": secret}
+		}
+		docs = append(docs, k8sKey)
+	}
+
+	var out strings.Builder
+	for _, doc := range docs {
+		encoded, err := yaml.Marshal(doc)
+		if err != nil {
+			abort("Export to k8s-split failed")
+		}
+		out.WriteString("---\n")
+		out.Write(encoded)
+	}
+	return []byte(out.String())
+}
+
+// apply the ConfigMap and Secret to the cluster kubectl points at, from its
+// kubeconfig or the pod's service account. kubectl apply creates or updates
+// each object, so repeating an export only changes what differs
+func applyK8s(content *cephMetaData, settings *runtimeSettings) error {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return errors.New("--k8s-apply needs kubectl, which is not on the PATH")
+	}
+
+	ctx := context.Background()
+	if settings.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.timeout)
+		defer cancel()
+	}
+	out, err := runCommand(ctx, []string{"kubectl", "apply", "-f", "/dev/fd/3"}, toK8sSplit(content, settings))
+	if err != nil {
+		return errors.New("kubectl was unable to apply the ConfigMap and Secret (" + err.Error() + ")")
+	}
+
+	// kubectl reports each object as created, configured or unchanged
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fmt.Fprintln(settings.progress, "Kubernetes "+line)
+	}
+	return nil
+}
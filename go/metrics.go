@@ -0,0 +1,96 @@
+package main
+
+//
+// self metrics for serve mode, so the exporter itself can be alerted on when
+// it's unable to reach the cluster. The text exposition format is simple
+// enough to write directly, without pulling in the prometheus client
+//
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// serverMetrics tracks collection outcomes
+type serverMetrics struct {
+	sync.Mutex
+	lastSuccess      time.Time
+	lastDuration     time.Duration
+	collections      int
+	collectionErrors int
+	commandErrors    map[string]int
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{commandErrors: make(map[string]int)}
+}
+
+// record the outcome of a collection
+func (m *serverMetrics) observe(duration time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.collections++
+	m.lastDuration = duration
+	if err != nil {
+		m.collectionErrors++
+		return
+	}
+	m.lastSuccess = time.Now()
+}
+
+// metricsRunner counts the failures of each command it runs
+type metricsRunner struct {
+	next    CommandRunner
+	metrics *serverMetrics
+}
+
+func (r metricsRunner) Run(commandString string) (string, error) {
+	out, err := r.next.Run(commandString)
+	if err != nil {
+		r.metrics.Lock()
+		r.metrics.commandErrors[commandString]++
+		r.metrics.Unlock()
+	}
+	return out, err
+}
+
+// write a metric in the prometheus text format
+func writeMetric(w http.ResponseWriter, name string, metricType string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, metricType, name, value)
+}
+
+func (m *serverMetrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var lastSuccess float64
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+	writeMetric(w, "ceph_export_last_success_timestamp_seconds", "gauge",
+		"Time of the last successful collection", lastSuccess)
+	writeMetric(w, "ceph_export_collection_duration_seconds", "gauge",
+		"Duration of the last collection", m.lastDuration.Seconds())
+	writeMetric(w, "ceph_export_collections_total", "counter",
+		"Number of collections attempted", float64(m.collections))
+	writeMetric(w, "ceph_export_collection_errors_total", "counter",
+		"Number of collections that failed", float64(m.collectionErrors))
+
+	var commands []string
+	for command := range m.commandErrors {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	fmt.Fprintln(w, "# HELP ceph_export_command_errors_total Number of failures of each command")
+	fmt.Fprintln(w, "# TYPE ceph_export_command_errors_total counter")
+	for _, command := range commands {
+		fmt.Fprintf(w, "ceph_export_command_errors_total{command=%q} %d\n", command, m.commandErrors[command])
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+//
+// multiple clusters - export each cluster named by a repeated --cluster or
+// --confdir in one run, collecting several at once
+//
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// check whether --cluster or --confdir was repeated
+func multiCluster(settings *runtimeSettings) bool {
+	return len(settings.clusters) > 1 || len(settings.confDirs) > 1
+}
+
+// pair each --cluster with its --confdir. A flag given once applies to every
+// cluster, otherwise the two are paired in the order given
+func clusterTargets(settings *runtimeSettings) ([]*runtimeSettings, error) {
+	clusters := settings.clusters
+	if len(clusters) == 0 {
+		clusters = []string{settings.cluster}
+	}
+	confDirs := settings.confDirs
+	if len(confDirs) == 0 {
+		confDirs = []string{settings.confDir}
+	}
+
+	count := len(clusters)
+	if len(confDirs) > count {
+		count = len(confDirs)
+	}
+	if len(clusters) != count && len(clusters) != 1 || len(confDirs) != count && len(confDirs) != 1 {
+		return nil, errors.New("--cluster and --confdir must be given once, or the same number of times")
+	}
+
+	var targets []*runtimeSettings
+	for i := 0; i < count; i++ {
+		target := *settings
+		target.cluster = clusters[0]
+		if len(clusters) > 1 {
+			target.cluster = clusters[i]
+		}
+		target.confDir = confDirs[0]
+		if len(confDirs) > 1 {
+			target.confDir = confDirs[i]
+		}
+		target.keyringPattern = clusterKeyringPattern(settings.keyringPattern, target.cluster)
+		targets = append(targets, &target)
+	}
+	return targets, nil
+}
+
+// a label for a cluster in messages, which needs the confdir when the same
+// cluster name is used more than once
+func targetLabel(target *runtimeSettings, distinct bool) string {
+	if distinct {
+		return target.cluster
+	}
+	return target.cluster + " (" + target.confDir + ")"
+}
+
+// check whether every target has its own cluster name
+func distinctClusters(targets []*runtimeSettings) bool {
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if seen[target.cluster] {
+			return false
+		}
+		seen[target.cluster] = true
+	}
+	return true
+}
+
+// the output name for a cluster's export. {cluster} and {fingerprint} are
+// replaced, and a name with neither is given the cluster name, or the
+// fingerprint when clusters share a name, so no export overwrites another
+func clusterOutputName(name string, cluster string, content *cephMetaData, distinct bool) string {
+	if !strings.Contains(name, "{cluster}") && !strings.Contains(name, "{fingerprint}") {
+		if distinct {
+			name += "-{cluster}"
+		} else {
+			name += "-{fingerprint}"
+		}
+	}
+	return strings.NewReplacer("{cluster}", cluster, "{fingerprint}", content.Fingerprint).Replace(name)
+}
+
+// the options that only make sense for a single cluster
+func checkMultiCluster(settings *runtimeSettings) {
+	if _, err := clusterTargets(settings); err != nil {
+		abort(err.Error())
+	}
+	switch {
+	case settings.outFile == "-":
+		abort("exporting several clusters needs an --output file name, not stdout")
+	case settings.s3Bucket != "":
+		abort("--s3-bucket can't be used when exporting several clusters")
+	case settings.socket != "":
+		abort("--socket can't be used when exporting several clusters")
+	case settings.k8sApply:
+		// every cluster would be applied to the same --k8s-name
+		abort("--k8s-apply can't be used when exporting several clusters")
+	case settings.configFd >= 0 || settings.keyringFd >= 0:
+		abort("--config-fd and --keyring-fd can't be used when exporting several clusters")
+	case os.Getenv("CEPH_CONF") != "" || os.Getenv("CEPH_KEYRING") != "":
+		// they would replace every cluster's own config or keyring
+		abort("CEPH_CONF and CEPH_KEYRING can't be set when exporting several clusters")
+	case settings.cephadmFsid != "":
+		abort("--cephadm-fsid can't be used when exporting several clusters")
+	case settings.parallel < 1:
+		abort("--parallel must be at least 1")
+	}
+}
+
+// collect one cluster's export, returning any failure rather than aborting
+// so the other clusters carry on
+func collectCluster(target *runtimeSettings) (*cephMetaData, error) {
+	selectConfDir(target)
+	if _, err := ready(target); err != nil {
+		return nil, err
+	}
+	key, _, err := fetchKeyring(target)
+	if err != nil {
+		return nil, errors.New("unable to load a key for client." + target.cephID + ": " + err.Error())
+	}
+
+	content, err := collectWithin(target, nil)
+	if err != nil {
+		return nil, err
+	}
+	applyLocalConfig(content, target)
+	content.Secret = key
+	if err := checkRequiredFields(content, target); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// export every cluster, collecting up to --parallel of them at once. The
+// exports are written one at a time, as writing can prompt, and the outcome
+// for each cluster is summarised at the end
+func exportClusters(settings *runtimeSettings, audit auditLog) {
+	targets, _ := clusterTargets(settings)
+	distinct := distinctClusters(targets)
+
+	contents := make([]*cephMetaData, len(targets))
+	errs := make([]error, len(targets))
+	slots := make(chan struct{}, settings.parallel)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		// the step by step progress of concurrent collections would be
+		// interleaved, so only the summary is shown
+		target.progress = ioutil.Discard
+		if settings.captureDir != "" {
+			target.captureDir = filepath.Join(settings.captureDir, strings.NewReplacer("/", "_", " ", "_").Replace(targetLabel(target, distinct)))
+		}
+
+		wg.Add(1)
+		go func(i int, target *runtimeSettings) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			contents[i], errs[i] = collectCluster(target)
+		}(i, target)
+	}
+	fmt.Fprintf(settings.progress, "\nCollecting %d clusters, %d at a time\n", len(targets), settings.parallel)
+	wg.Wait()
+
+	checkWarnings(settings)
+
+	var failures []string
+	written := make(map[string]string)
+	fmt.Fprintln(settings.progress)
+	for i, target := range targets {
+		label := targetLabel(target, distinct)
+		if errs[i] == nil {
+			// each confdir is queried through its own config, so a shared
+			// fingerprint really is the same cluster reached twice
+			target.outFile = clusterOutputName(settings.outFile, target.cluster, contents[i], distinct)
+			if other, ok := written[target.outFile]; ok {
+				errs[i] = errors.New("its export would replace the one from " + other)
+			}
+			written[target.outFile] = label
+		}
+		if errs[i] == nil {
+			errs[i] = exportMetadata(contents[i], target)
+		}
+		if errs[i] != nil {
+			failures = append(failures, label+": "+errs[i].Error())
+			fmt.Fprintf(os.Stderr, "%-20s FAILED (%s)\n", label, errs[i])
+			continue
+		}
+		if audit != nil {
+			auditExport(audit, contents[i], target)
+		}
+		fmt.Fprintf(settings.progress, "%-20s written to %s\n", label, withExtension(target.outFile, target))
+	}
+
+	if len(failures) > 0 {
+		message := fmt.Sprintf("%d of %d clusters failed", len(failures), len(targets))
+		if abortHook != nil {
+			abortHook(message)
+		}
+		if errorFormat == "json" {
+			exitWithError(exportError{Error: message, Code: 4, Failures: failures})
+		}
+		fmt.Fprintln(os.Stderr, "\nUnable to continue: "+message)
+		os.Exit(4)
+	}
+}
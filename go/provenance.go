@@ -0,0 +1,90 @@
+package main
+
+//
+// provenance - record where each exported field came from, so a field left
+// empty by a failed command is easy to tell apart from one never collected
+//
+
+import (
+	"reflect"
+)
+
+// fieldSources gives the command, or local source, each field is taken from
+var fieldSources = map[string]string{
+	"dashboard_url":            "ceph -s",
+	"dashboard_tls":            "ceph -s",
+	"dashboard_on_active_mgr":  "ceph -s",
+	"prometheus_on_active_mgr": "ceph -s",
+	"dashboard_reachable":      "http request to the dashboard url",
+	"prometheus_reachable":     "http request to the prometheus url",
+	"fsid":                     "ceph -s",
+	"fingerprint":              "ceph -s",
+	"cluster_name":             "--cluster-label, local ceph.conf or --cluster",
+	"public_network":           "local ceph.conf",
+	"cluster_network":          "local ceph.conf",
+	"secret":                   "local keyring",
+	"mgr":                      "ceph -s",
+	"mgr_addr":                 "ceph -s",
+	"mgr_port":                 "ceph -s",
+	"mgr_standby":              "ceph -s",
+	"mons":                     "ceph -s",
+	"mon_v2":                   "ceph -s",
+	"mon_public_addrs":         "ceph -s",
+	"prometheus_url":           "ceph -s",
+	"rgws":                     "ceph -s",
+	"rgw_endpoints":            "ceph -s",
+	"rgw_daemons":              "ceph -s",
+	"version":                  "ceph version",
+	"release_name":             "ceph version",
+	"monmap_epoch":             "ceph -s",
+	"election_epoch":           "ceph -s",
+	"monmap_created":           "ceph -s",
+	"monmap_modified":          "ceph -s",
+	"enabled_modules":          "ceph -s",
+	"health_checks":            "ceph -s",
+	"pg_count":                 "ceph -s",
+	"pg_states":                "ceph -s",
+	"telemetry_enabled":        "ceph telemetry status",
+	"balancer_mode":            "ceph balancer status",
+	"balancer":                 "ceph balancer status, ceph osd dump",
+	"dashboard_custom_cert":    "ceph config-key ls",
+	"dashboard_user":           "ceph dashboard ac-user-show",
+	"autoscale":                "ceph osd pool autoscale-status",
+	"ratios":                   "ceph osd dump",
+	"daemon_versions":          "ceph versions",
+	"require_osd_release":      "ceph osd dump",
+	"min_mon_release":          "ceph mon dump",
+	"exported_from":            "local hostname",
+	"exported_at":              "local clock",
+	"custom":                   "registered collectors",
+}
+
+// check for a zero value, or a list or map with nothing in it
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	return value.IsZero()
+}
+
+// record the source of every populated field that's exported, under
+// _provenance. A field missing from it was left empty
+func recordProvenance(content *cephMetaData, settings *runtimeSettings) {
+	if !settings.withProvenance {
+		return
+	}
+
+	excluded := excludedFields(settings)
+	provenance := make(map[string]string)
+	value := reflect.ValueOf(content).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := fieldName(value.Type().Field(i))
+		source, ok := fieldSources[name]
+		if !ok || isEmpty(value.Field(i)) || hasString(name, excluded) {
+			continue
+		}
+		provenance[name] = source
+	}
+	content.Provenance = provenance
+}
@@ -0,0 +1,176 @@
+package main
+
+//
+// s3 upload - put the export into an S3 compatible bucket. A single signed
+// PUT is all that's needed, so the request is signed here (AWS signature
+// version 4) rather than pulling in an SDK
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Target is the bucket endpoint and credentials, taken from the standard
+// AWS environment variables
+type s3Target struct {
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// read the first of the environment variables that is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// build the upload target from the environment. Without an endpoint url the
+// region's AWS endpoint is used
+func s3TargetFromEnv() (*s3Target, error) {
+	target := s3Target{
+		endpoint:     firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if target.accessKey == "" || target.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for an S3 upload")
+	}
+	if target.region == "" {
+		target.region = "us-east-1"
+	}
+	if target.endpoint == "" {
+		target.endpoint = "https://s3." + target.region + ".amazonaws.com"
+	}
+	return &target, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// escape each segment of an object path, as the canonical request expects
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.PathEscape(segment), "+", "%2B", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sign the request with AWS signature version 4. The headers signed are the
+// minimum S3 requires, plus the session token when there is one
+func (t *s3Target) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if t.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", t.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + t.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+t.secretKey), day)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.accessKey, scope, signedHeaders, signature))
+}
+
+// upload the export to the bucket, using path style addressing so any S3
+// compatible store (such as the rados gateway) can be targeted
+func uploadS3(output []byte, settings *runtimeSettings) error {
+	target, err := s3TargetFromEnv()
+	if err != nil {
+		return err
+	}
+
+	objectURL := strings.TrimRight(target.endpoint, "/") + "/" + escapePath(settings.s3Bucket) + "/" +
+		escapePath(strings.TrimLeft(settings.s3Key, "/"))
+
+	ctx := context.Background()
+	if settings.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(output))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	contentType := outputFormats[settings.fileFormat].contentType
+	if len(settings.gpgRecipients) > 0 {
+		contentType = "application/pgp-encrypted"
+	}
+	req.Header.Set("Content-Type", contentType)
+	target.sign(req, sha256Hex(output), time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("upload to s3://%s/%s failed with %s", settings.s3Bucket, settings.s3Key, resp.Status)
+	}
+	return nil
+}
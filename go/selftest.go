@@ -0,0 +1,198 @@
+package main
+
+//
+// self test - run the collection against embedded ceph output, so packagers
+// can check the parsing logic without a cluster
+//
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// fixtureName gives the filename holding the output of a command, for
+// example "ceph -s -f json" is held in ceph-s.json
+func fixtureName(commandString string) string {
+	var parts []string
+	ext := ".txt"
+
+	args := strings.Split(commandString, " ")
+	for i := 0; i < len(args); i++ {
+		if (args[i] == "-f" || args[i] == "--format") && i+1 < len(args) {
+			ext = "." + args[i+1]
+			i++
+			continue
+		}
+		parts = append(parts, strings.TrimLeft(args[i], "-"))
+	}
+	return strings.Join(parts, "-") + ext
+}
+
+// fixtureRunner answers commands from previously captured output
+type fixtureRunner struct {
+	read func(name string) ([]byte, error)
+}
+
+func (r fixtureRunner) Run(commandString string) (string, error) {
+	out, err := r.read(fixtureName(commandString))
+	if err != nil {
+		return "", errors.New("no fixture for '" + commandString + "'")
+	}
+	return string(out), nil
+}
+
+// captureRunner saves the output of each command it runs as a fixture, so
+// what the tool saw on a real cluster can be replayed later
+type captureRunner struct {
+	next CommandRunner
+	dir  string
+}
+
+func (r captureRunner) Run(commandString string) (string, error) {
+	out, err := r.next.Run(commandString)
+	if err != nil {
+		return out, err
+	}
+
+	fileName := filepath.Join(r.dir, fixtureName(commandString))
+	err = os.MkdirAll(r.dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(fileName, []byte(withoutPassword(commandString, out)), 0600)
+	}
+	if err != nil {
+		logWarning("unable to capture the output of '" + commandString + "' (" + err.Error() + ")")
+	}
+	return out, nil
+}
+
+// remove the password hash from a dashboard user's details, so a capture
+// never holds a credential. Output that can't be checked isn't kept at all
+func withoutPassword(commandString string, out string) string {
+	if !strings.HasPrefix(commandString, "ceph dashboard ac-user-show ") {
+		return out
+	}
+	var details interface{}
+	if err := json.Unmarshal([]byte(out), &details); err != nil {
+		return ""
+	}
+	user, ok := details.(map[string]interface{})
+	if !ok {
+		// the list of user names
+		return out
+	}
+	delete(user, "password")
+	stripped, _ := json.MarshalIndent(user, "", "    ")
+	return string(stripped)
+}
+
+// run the collection against the embedded fixtures, exiting non-zero if the
+// result differs from the expected export
+func selfTest() {
+
+	// start from the defaults, regardless of any other flags given
+	var settings runtimeSettings
+	fs := flag.NewFlagSet("self-test", flag.ExitOnError)
+	addFlags(fs, &settings)
+	addOutputFlags(fs, &settings)
+	fs.Parse(nil)
+	prepareSettings(fs, &settings)
+	prepareOutput(fs, &settings)
+	settings.progress = ioutil.Discard
+
+	// the hostname differs on every build host, and the time on every run
+	settings.noHostname = true
+	settings.clock = fixedClock{selfTestTime}
+
+	runner := fixtureRunner{
+		read: func(name string) ([]byte, error) {
+			return fixtures.ReadFile("fixtures/" + name)
+		},
+	}
+
+	data, err := collectMetadata(runner, &settings)
+	if err != nil {
+		abort("self test collection failed: " + err.Error())
+	}
+
+	got, _ := json.MarshalIndent(data, "", "    ")
+	want, _ := json.MarshalIndent(expectedSelfTest(), "", "    ")
+	if !bytes.Equal(got, want) {
+		fmt.Fprintf(os.Stderr, "Expected:\n%s\nGot:\n%s\n", want, got)
+		fmt.Fprintln(os.Stderr, "Self test FAILED")
+		os.Exit(1)
+	}
+	fmt.Println("Self test PASSED")
+}
+
+// selfTestTime is when the self test claims to run
+var selfTestTime = time.Date(2019, time.September, 17, 10, 0, 0, 0, time.UTC)
+
+// fixedClock always gives the same time
+type fixedClock struct {
+	at time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.at
+}
+
+// expectedSelfTest is the metadata the fixtures should produce
+func expectedSelfTest() *cephMetaData {
+	onActive := true
+	expected := &cephMetaData{
+		DashboardURL:          "http://rhcs4-2.storage.lab:8443/",
+		DashboardOnActiveMgr:  &onActive,
+		PrometheusOnActiveMgr: &onActive,
+		Fsid:                  "6d210768-d391-409b-b585-56d54554da8c",
+		Fingerprint:           "ef782ad99ba8",
+		Mgr:                   "10.90.90.161",
+		MgrAddr:               "10.90.90.161:6801",
+		MgrPort:               6801,
+		Mgrstandby:            []string{"10.90.90.153", "10.90.90.160"},
+		Mons:                  []string{"10.90.90.153:6789/0", "10.90.90.160:6789/0", "10.90.90.161:6789/0"},
+		MonV2:                 []string{"10.90.90.153:3300", "10.90.90.160:3300", "10.90.90.161:3300"},
+		MonPublicAddrs: []MonPublicAddrs{
+			{Name: "a", Addrs: []MonAddress{{Type: "v2", Addr: "10.90.90.153:3300"}, {Type: "v1", Addr: "10.90.90.153:6789"}}},
+			{Name: "b", Addrs: []MonAddress{{Type: "v2", Addr: "10.90.90.160:3300"}, {Type: "v1", Addr: "10.90.90.160:6789"}}},
+			{Name: "c", Addrs: []MonAddress{{Type: "v2", Addr: "10.90.90.161:3300"}, {Type: "v1", Addr: "10.90.90.161:6789"}}},
+		},
+		PrometheusURL:  "http://rhcs4-2.storage.lab:9283/",
+		Rgws:           []string{"8080"},
+		RgwEndpoints:   []string{"rhcs4-1.storage.lab:8080"},
+		RgwDaemons:     []string{"rgw1"},
+		Version:        "14.2.2",
+		ReleaseName:    "nautilus",
+		MonmapEpoch:    3,
+		ElectionEpoch:  32,
+		MonmapCreated:  "2019-09-16T20:40:11Z",
+		MonmapModified: "2019-09-16T20:44:37Z",
+		EnabledModules: []string{"dashboard", "iostat", "prometheus", "restful"},
+		HealthChecks:   []HealthCheck{},
+		PGCount:        128,
+		PGStates:       map[string]int{"active+clean": 120, "active+remapped+backfilling": 8},
+		ExportedAt:     "2019-09-17T10:00:00Z",
+	}
+
+	// the example collector is only in builds tagged example_collector
+	if _, ok := collectors["telemetry"]; ok {
+		expected.Custom = map[string]interface{}{
+			"telemetry": map[string]interface{}{
+				"enabled":     false,
+				"last_upload": nil,
+			},
+		}
+	}
+	return expected
+}
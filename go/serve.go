@@ -0,0 +1,172 @@
+package main
+
+//
+// serve mode - instead of writing a file, collect the metadata on demand
+// and return it over http
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// metadataCache holds the last collection, so frequent requests don't each
+// run ceph -s against the cluster
+type metadataCache struct {
+	sync.Mutex
+	ttl       time.Duration
+	data      *cephMetaData
+	collected time.Time
+	collect   func() (*cephMetaData, error)
+	settings  *runtimeSettings
+}
+
+// return the cached metadata, collecting it again once the ttl has passed
+func (c *metadataCache) get() (*cephMetaData, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.data != nil && time.Since(c.collected) < c.ttl {
+		return c.data, nil
+	}
+
+	data, err := c.collect()
+	if err != nil {
+		return nil, err
+	}
+	c.data = data
+	c.collected = time.Now()
+	return c.data, nil
+}
+
+// wantsYAML checks the Accept header for a yaml media type
+func wantsYAML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/yaml") ||
+		strings.Contains(accept, "application/x-yaml") ||
+		strings.Contains(accept, "text/yaml")
+}
+
+func (c *metadataCache) handleMetadata(w http.ResponseWriter, r *http.Request) {
+
+	data, err := c.get()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	view := exportView(data, c.settings)
+
+	var out []byte
+	if wantsYAML(r) {
+		w.Header().Set("Content-Type", "application/yaml")
+		out, err = yaml.Marshal(view)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		out, err = json.MarshalIndent(view, "", c.settings.indent)
+	}
+	if err != nil {
+		http.Error(w, "unable to encode the metadata", http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// serveOptions are the flags only serve takes
+type serveOptions struct {
+	listen   string
+	cacheTTL time.Duration
+	metrics  bool
+}
+
+func addServeFlags(fs *flag.FlagSet, opts *serveOptions) {
+	fs.StringVar(&opts.listen, "listen", "127.0.0.1:9288", "address to listen on")
+	fs.DurationVar(&opts.cacheTTL, "cache-ttl", 30*time.Second, "how long a collection is reused")
+	fs.BoolVar(&opts.metrics, "metrics", false, "expose the exporter's own metrics on /metrics")
+}
+
+// run the http server. The export holds the cluster key, so by default the
+// server only listens on the loopback interface
+func serve(args []string, settings *runtimeSettings) {
+
+	var opts serveOptions
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addFlags(fs, settings)
+	addServeFlags(fs, &opts)
+	fs.Parse(args)
+	prepareSettings(fs, settings)
+	if multiCluster(settings) {
+		abort("serve exports a single cluster, so --cluster and --confdir can't be repeated")
+	}
+
+	key := prepareExport(settings)
+
+	// per request progress would just be noise in the server's output
+	settings.progress = ioutil.Discard
+
+	var metrics *serverMetrics
+	var wrap func(CommandRunner) CommandRunner
+	if opts.metrics {
+		metrics = newServerMetrics()
+		wrap = func(runner CommandRunner) CommandRunner {
+			return metricsRunner{next: runner, metrics: metrics}
+		}
+	}
+
+	cache := metadataCache{
+		ttl:      opts.cacheTTL,
+		settings: settings,
+		collect: func() (*cephMetaData, error) {
+			resetWarnings()
+			start := time.Now()
+			data, err := collectWithin(settings, wrap)
+			if metrics != nil {
+				metrics.observe(time.Since(start), err)
+			}
+			if err != nil {
+				logWarning("collection failed (" + err.Error() + ")")
+				return nil, err
+			}
+			applyLocalConfig(data, settings)
+			// the export is refused rather than the server stopping, as
+			// the next collection may be clean
+			if settings.failOnWarn && warningCount() > 0 {
+				err := fmt.Errorf("%d warning(s) with --fail-on-warn", warningCount())
+				logWarning("collection failed (" + err.Error() + ")")
+				return nil, err
+			}
+			data.Secret = key
+			if err := checkRequiredFields(data, settings); err != nil {
+				logWarning("collection failed (" + err.Error() + ")")
+				return nil, err
+			}
+			recordProvenance(data, settings)
+			return data, nil
+		},
+	}
+
+	http.HandleFunc("/metadata", cache.handleMetadata)
+	http.HandleFunc("/healthz", handleHealthz)
+	if metrics != nil {
+		http.HandleFunc("/metrics", metrics.handleMetrics)
+	}
+
+	fmt.Fprintln(os.Stderr, "Serving cluster metadata on "+opts.listen)
+	err := http.ListenAndServe(opts.listen, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		abort("Unable to start the http server")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+//
+// socket output - hand the export to a local collector listening on a unix
+// domain socket
+//
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// connect to the --socket and write the export, within --timeout
+func writeSocket(output []byte, settings *runtimeSettings) error {
+	conn, err := net.DialTimeout("unix", settings.socket, settings.timeout)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the socket %s (%s)", settings.socket, err)
+	}
+	defer conn.Close()
+
+	if settings.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(settings.timeout))
+	}
+	_, err = conn.Write(output)
+	if err != nil {
+		return fmt.Errorf("unable to write to the socket %s (%s)", settings.socket, err)
+	}
+	return nil
+}
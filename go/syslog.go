@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"log/syslog"
+)
+
+// syslogFacilities maps the --syslog-facility names to their priority
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// connect to the local syslog
+func openAuditLog(facility string, tag string) (auditLog, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("unknown syslog facility '" + facility + "'")
+	}
+	return syslog.New(priority|syslog.LOG_INFO, tag)
+}
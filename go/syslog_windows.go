@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// there's no syslog on windows
+func openAuditLog(facility string, tag string) (auditLog, error) {
+	return nil, errors.New("syslog isn't available on windows")
+}
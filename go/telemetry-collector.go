@@ -0,0 +1,44 @@
+//go:build example_collector
+// +build example_collector
+
+package main
+
+//
+// example custom collector, reporting the state of the telemetry module.
+// Site specific collectors follow the same pattern - implement Collector and
+// register it from an init function. It's only built with
+// -tags example_collector, so a normal build runs no extra commands
+//
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+type telemetryCollector struct{}
+
+func init() {
+	registerCollector("telemetry", telemetryCollector{})
+}
+
+func (c telemetryCollector) Collect(runner CommandRunner) (map[string]interface{}, error) {
+
+	out, err := runner.Run("ceph telemetry status -f json")
+	if err != nil {
+		return nil, errors.New("unable to query the telemetry module")
+	}
+
+	var status map[string]interface{}
+	err = json.Unmarshal([]byte(out), &status)
+	if err != nil {
+		return nil, errors.New("unable to parse telemetry status")
+	}
+
+	telemetry := make(map[string]interface{})
+	for _, key := range []string{"enabled", "last_upload"} {
+		if value, ok := status[key]; ok {
+			telemetry[key] = value
+		}
+	}
+	return map[string]interface{}{"telemetry": telemetry}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+//
+// template output - render the metadata through a text/template, either a
+// user's own file or one of the built in integrations
+//
+
+import (
+	"bytes"
+	"embed"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates
+var builtinTemplates embed.FS
+
+// the names of the built in templates, sorted
+func templateNames() []string {
+	var names []string
+	entries, _ := builtinTemplates.ReadDir("templates")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".tmpl"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hostport reduces a mon address or a service url to host:port, which is
+// what proxy configs expect
+func hostport(addr string) string {
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return addr
+		}
+		return u.Host
+	}
+	host, port, err := splitCephAddr(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// load the template given by --template, or else --template-name
+func loadTemplate(settings *runtimeSettings) (*template.Template, error) {
+	var text []byte
+	var err error
+	name := settings.templateName
+	if settings.templateFile != "" {
+		name = path.Base(settings.templateFile)
+		text, err = ioutil.ReadFile(settings.templateFile)
+	} else {
+		text, err = builtinTemplates.ReadFile("templates/" + settings.templateName + ".tmpl")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Funcs(template.FuncMap{"hostport": hostport}).Parse(string(text))
+}
+
+// render the metadata through the selected template. Templates see every
+// field by its go name e.g. {{ .Mons }}, after any redaction
+func renderTemplate(content *cephMetaData, settings *runtimeSettings) []byte {
+	tmpl, err := loadTemplate(settings)
+	if err != nil {
+		abort("Unable to load the template (" + err.Error() + ")")
+	}
+
+	data := *redactMetadata(content, settings)
+	if settings.noSecret {
+		data.Secret = ""
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, data)
+	if err != nil {
+		abort("Unable to render the template (" + err.Error() + ")")
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// replace the process umask, so the files written don't depend on the one
+// inherited from cron or systemd
+func setUmask(mask int) error {
+	syscall.Umask(mask)
+	return nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// windows has no umask, permissions come from the directory's acl
+func setUmask(mask int) error {
+	return errors.New("--umask isn't supported on windows")
+}
@@ -0,0 +1,93 @@
+package main
+
+//
+// validate - check an existing export can be read back, catching hand edits
+// and drift between the producer and the consumer
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+// decode an export, by its extension. Under strict, a field the current
+// metadata doesn't define is an error rather than ignored
+func decodeExport(fileName string, data []byte, strict bool) (*cephMetaData, error) {
+	var content cephMetaData
+
+	switch path.Ext(fileName) {
+	case ".yaml", ".yml":
+		unmarshal := yaml.Unmarshal
+		if strict {
+			unmarshal = yaml.UnmarshalStrict
+		}
+		if err := unmarshal(data, &content); err != nil {
+			return nil, err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		if strict {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(&content); err != nil {
+			return nil, err
+		}
+	}
+	return &content, nil
+}
+
+// check the fields every consumer relies on are present
+func checkExport(content *cephMetaData) error {
+	if content.Fsid == "" {
+		return errors.New("the fsid is missing")
+	}
+	if len(content.Mons) == 0 {
+		return errors.New("there are no mons")
+	}
+	return nil
+}
+
+func addValidateFlags(fs *flag.FlagSet, strictJSON *bool) {
+	fs.BoolVar(strictJSON, "strict-json", false, "reject fields the current export format doesn't define")
+}
+
+// validate an export file, exiting non-zero when it can't be used
+func validate(args []string) {
+
+	var strictJSON bool
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	addValidateFlags(fs, &strictJSON)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate [--strict-json] <export file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	fileName := fs.Arg(0)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		abort(err.Error())
+	}
+
+	content, err := decodeExport(fileName, data, strictJSON)
+	if err == nil {
+		err = checkExport(content)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is not a valid export: %s\n", fileName, err)
+		os.Exit(1)
+	}
+	fmt.Println(fileName + " is a valid export")
+}